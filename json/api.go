@@ -0,0 +1,174 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// API descriptor
+// ----------------------------------------------------------------------------
+
+// NewAPIHandler returns an APIHandler describing the methods of reg, served
+// by the router at url. namespace is the client namespace of the actions.
+func NewAPIHandler(reg *Registry, url, namespace string) *APIHandler {
+	return &APIHandler{registry: reg, url: url, namespace: namespace}
+}
+
+// APIHandler is the http.Handler serving the ExtDirect API descriptor.
+//
+// The descriptor lists the methods of the registry and is served as a
+// script defining Ext.app.REMOTING_API, and Ext.app.POLLING_API when a poll
+// endpoint is mounted. Requests with format=json in the query get the
+// remoting descriptor as JSON instead.
+//
+// Responses carry an ETag computed from the descriptor, and so from the
+// registry contents. Requests whose If-None-Match header holds it are
+// answered with 304 Not Modified and no body.
+type APIHandler struct {
+	registry  *Registry
+	url       string
+	namespace string
+	pollURL   string
+}
+
+// apiMethod describes a method in the API descriptor.
+type apiMethod struct {
+	Name        string `json:"name"`
+	Len         int    `json:"len"`
+	FormHandler bool   `json:"formHandler,omitempty"`
+}
+
+// apiDescriptor is the ExtDirect remoting API descriptor.
+type apiDescriptor struct {
+	URL       string                 `json:"url"`
+	Type      string                 `json:"type"`
+	Namespace string                 `json:"namespace,omitempty"`
+	Actions   map[string][]apiMethod `json:"actions"`
+}
+
+// descriptor returns the remoting descriptor of the registry.
+func (h *APIHandler) descriptor() *apiDescriptor {
+	d := &apiDescriptor{
+		URL:       h.url,
+		Type:      "remoting",
+		Namespace: h.namespace,
+		Actions:   make(map[string][]apiMethod),
+	}
+	for _, m := range h.registry.Methods() {
+		d.Actions[m.Action] = append(d.Actions[m.Action], apiMethod{
+			Name:        m.Name,
+			Len:         m.Len,
+			FormHandler: m.FormHandler,
+		})
+	}
+	return d
+}
+
+// ServeHTTP implements http.Handler.
+func (h *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(h.descriptor())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The tag covers what the response depends on: the registry, through
+	// the descriptor, the poll endpoint and the format.
+	format := r.URL.Query().Get("format")
+	tag := descriptorETag(b, h.pollURL, format)
+	w.Header().Set("ETag", tag)
+	if matchesETag(r.Header.Get("If-None-Match"), tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(append(b, '\n'))
+		return
+	}
+	script := []string{
+		`Ext.ns("Ext.app");`,
+		"Ext.app.REMOTING_API = " + string(b) + ";",
+	}
+	if h.pollURL != "" {
+		p, _ := json.Marshal(map[string]string{"type": "polling", "url": h.pollURL})
+		script = append(script, "Ext.app.POLLING_API = "+string(p)+";")
+	}
+	w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	w.Write([]byte(strings.Join(script, "\n") + "\n"))
+}
+
+// descriptorETag returns the entity tag of the descriptor response built
+// from the encoded descriptor b.
+func descriptorETag(b []byte, pollURL, format string) string {
+	sum := sha256.New()
+	sum.Write(b)
+	sum.Write([]byte("\x00" + pollURL + "\x00" + format))
+	return `"` + hex.EncodeToString(sum.Sum(nil)[:16]) + `"`
+}
+
+// matchesETag reports whether the If-None-Match header value h matches
+// tag, using the weak comparison.
+func matchesETag(h, tag string) bool {
+	for _, t := range strings.Split(h, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ----------------------------------------------------------------------------
+// Mount
+// ----------------------------------------------------------------------------
+
+// Mount registers the ExtDirect endpoints of the router in mux under base:
+// the API descriptor at base/api, the router at base/router and, if the
+// codec uses WithPoll, the poll endpoint at base/poll. The descriptor lists
+// the methods of the codec registry under namespace. In debug mode with
+// WithRecentErrors, RecentErrorsHandler is also served at base/errors.
+//
+// Each endpoint is also served with a trailing slash, such as
+// base/router/, without a redirect that clients posting calls would not
+// follow, unless the codec uses WithStrictPaths. Other paths below the
+// endpoints are not served.
+func (rt *Router) Mount(mux *http.ServeMux, base string, namespace string) {
+	base = strings.TrimSuffix(base, "/")
+	handle := func(path string, h http.Handler) {
+		mux.Handle(path, h)
+		if !rt.codec.strictPaths {
+			mux.Handle(path+"/", exactPath(path+"/", h))
+		}
+	}
+	api := NewAPIHandler(rt.codec.registry, base+"/router", namespace)
+	if rt.codec.poll != nil {
+		api.pollURL = base + "/poll"
+		handle(api.pollURL, NewPollHandler(rt.codec, rt.codec.poll))
+	}
+	if rt.codec.debug && rt.codec.recentErrors != nil {
+		handle(base+"/errors", rt.codec.RecentErrorsHandler())
+	}
+	handle(base+"/api", api)
+	handle(base+"/router", rt)
+}
+
+// exactPath returns a handler passing the requests for path to h and
+// answering the others with 404 Not Found, for patterns of http.ServeMux
+// ending in a slash, which match the whole subtree.
+func exactPath(path string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
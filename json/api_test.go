@@ -0,0 +1,148 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMount(t *testing.T) {
+	reg := NewRegistry()
+	reg.Add("Service1", "Multiply")
+	reg.Add("Files", "Upload").FormHandler = true
+	c := NewCodec(WithRegistry(reg), WithPoll(func(r *http.Request) ([]Event, error) {
+		return []Event{{"message", "hello"}}, nil
+	}))
+	mux := http.NewServeMux()
+	newRouter(c, new(Service1)).Mount(mux, "/direct/", "MyApp")
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/direct/api", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	body := w.Body.String()
+	if w.Code != 200 || !strings.Contains(body, "Ext.app.REMOTING_API = ") {
+		t.Fatalf("Expected the remoting descriptor, but got %v %q", w.Code, body)
+	}
+	if !strings.Contains(body, `Ext.app.POLLING_API = {"type":"polling","url":"/direct/poll"};`) {
+		t.Errorf("Expected the polling descriptor, but got %q", body)
+	}
+
+	r, _ = http.NewRequest("GET", "http://localhost:8080/direct/api?format=json", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	var api apiDescriptor
+	if err := json.Unmarshal(w.Body.Bytes(), &api); err != nil {
+		t.Fatalf("Expected a JSON descriptor, but got %q: %v", w.Body.String(), err)
+	}
+	if api.URL != "/direct/router" || api.Type != "remoting" || api.Namespace != "MyApp" {
+		t.Errorf("Unexpected descriptor %+v", api)
+	}
+	if m := api.Actions["Service1"]; len(m) != 1 || m[0] != (apiMethod{Name: "Multiply", Len: 1}) {
+		t.Errorf("Expected Service1.Multiply, but got %v", m)
+	}
+	if m := api.Actions["Files"]; len(m) != 1 || !m[0].FormHandler {
+		t.Errorf("Expected form handler Files.Upload, but got %v", m)
+	}
+
+	r = newRequest(`{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":[{"A":4,"B":2}]}`)
+	r.URL.Path = "/direct/router"
+	if w, env := route(mux, r); w.Code != 200 || env["result"].(map[string]interface{})["Result"] != float64(8) {
+		t.Errorf("Expected result 8 from the router, but got %v %v", w.Code, env)
+	}
+
+	r, _ = http.NewRequest("GET", "http://localhost:8080/direct/poll", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	var events []map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &events)
+	if len(events) != 1 || events[0]["data"] != "hello" {
+		t.Errorf("Expected the hello event, but got %v %q", w.Code, w.Body.String())
+	}
+}
+
+func TestMountWithoutPoll(t *testing.T) {
+	mux := http.NewServeMux()
+	newRouter(NewCodec(), new(Service1)).Mount(mux, "/direct", "")
+	r, _ := http.NewRequest("GET", "http://localhost:8080/direct/poll", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected no poll endpoint, but got %v", w.Code)
+	}
+}
+
+func TestMountTrailingSlash(t *testing.T) {
+	body := `{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":[{"A":4,"B":2}]}`
+	for _, strict := range []bool{false, true} {
+		var opts []Option
+		if strict {
+			opts = append(opts, WithStrictPaths())
+		}
+		mux := http.NewServeMux()
+		newRouter(NewCodec(opts...), new(Service1)).Mount(mux, "/direct", "")
+
+		for path, served := range map[string]bool{
+			"/direct/router":      true,
+			"/direct/router/":     !strict,
+			"/direct/router/more": false,
+		} {
+			r := newRequest(body)
+			r.URL.Path = path
+			w, env := route(mux, r)
+			if got := w.Code == 200 && env["type"] == "rpc"; got != served {
+				t.Errorf("Unexpected response to %s, strict %v: %v %q", path, strict, w.Code, w.Body.String())
+			}
+			if !served && w.Code != http.StatusNotFound {
+				t.Errorf("Expected 404 without redirect for %s, strict %v, but got %v", path, strict, w.Code)
+			}
+		}
+
+		r, _ := http.NewRequest("GET", "http://localhost:8080/direct/api/", nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if (w.Code == 200) == strict {
+			t.Errorf("Unexpected response to /direct/api/, strict %v: %v", strict, w.Code)
+		}
+	}
+}
+
+func TestAPIHandlerETag(t *testing.T) {
+	reg := NewRegistry()
+	reg.Add("Service1", "Multiply")
+	h := NewAPIHandler(reg, "/router", "")
+	get := func(query, match string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", "http://localhost:8080/api"+query, nil)
+		if match != "" {
+			r.Header.Set("If-None-Match", match)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("", "")
+	tag := w.Header().Get("ETag")
+	if w.Code != 200 || tag == "" || w.Body.Len() == 0 {
+		t.Fatalf("Expected the descriptor with an ETag, but got %v %v", w.Code, w.Header())
+	}
+	if w = get("", tag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("Expected an empty 304 for %s, but got %v %q", tag, w.Code, w.Body.String())
+	}
+	if w = get("", `"other", W/`+tag); w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for a list holding the weak tag, but got %v", w.Code)
+	}
+	if w = get("?format=json", tag); w.Code != 200 || w.Header().Get("ETag") == tag {
+		t.Errorf("Expected another tag for the JSON format, but got %v %v", w.Code, w.Header())
+	}
+
+	reg.Add("Service1", "Sleep")
+	if w = get("", tag); w.Code != 200 || w.Header().Get("ETag") == tag || !strings.Contains(w.Body.String(), "Sleep") {
+		t.Errorf("Expected the changed descriptor, but got %v %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrMissingToken is returned when token authentication is enabled and a
+// request carries no bearer token.
+var ErrMissingToken = errors.New("rpc: missing bearer token")
+
+// Principal identifies an authenticated caller. Its concrete type is
+// defined by the application.
+type Principal interface{}
+
+type principalKey struct{}
+
+// PrincipalFromContext returns the principal resolved by token
+// authentication, if any.
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(principalValue)
+	return p.Principal, ok
+}
+
+// principalValue wraps the principal stored in a context so that a nil
+// principal can still be told apart from a missing one.
+type principalValue struct {
+	Principal
+}
+
+// authenticate resolves the principal of r from its bearer token.
+func (c *Codec) authenticate(r *http.Request) (Principal, error) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return nil, ErrMissingToken
+	}
+	return c.tokenAuth(strings.TrimSpace(auth[7:]))
+}
+
+// authorize authenticates r if token authentication is enabled and no
+// principal was resolved yet, storing the principal in the request context.
+func (c *Codec) authorize(r *http.Request) error {
+	if c.tokenAuth == nil {
+		return nil
+	}
+	if _, ok := PrincipalFromContext(r.Context()); ok {
+		return nil
+	}
+	p, err := c.authenticate(r)
+	if err != nil {
+		return err
+	}
+	setContext(r, withPrincipal(r.Context(), p))
+	return nil
+}
+
+// withPrincipal returns a copy of ctx holding p.
+func withPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principalValue{p})
+}
@@ -0,0 +1,75 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"encoding/json"
+)
+
+// BulkResult is the reply of methods processing many items in a single
+// call, reporting the outcome of each item so that clients can show a
+// partial success. It is encoded under "result" as:
+//
+//	{"succeeded":[{"id":41}],"failed":[{"id":42,"message":"locked","code":"conflict"}]}
+//
+// Both arrays are always present, empty when no item is in them.
+type BulkResult struct {
+	Succeeded []ItemResult
+	Failed    []ItemResult
+}
+
+// ItemResult is the outcome of a single item of a BulkResult.
+type ItemResult struct {
+	// ID identifies the item.
+	ID interface{}
+	// Data is the result of an item that succeeded, if any.
+	Data interface{}
+	// Err is the failure of an item that failed. It is encoded as its
+	// message, and its code if it carries one like the exception errors.
+	Err error
+}
+
+// MarshalJSON encodes the item, writing only the members it uses.
+func (i ItemResult) MarshalJSON() ([]byte, error) {
+	fields := map[string]interface{}{"id": i.ID}
+	if i.Data != nil {
+		fields["data"] = i.Data
+	}
+	if i.Err != nil {
+		fields["message"] = i.Err.Error()
+		if c, ok := i.Err.(coder); ok {
+			fields["code"] = c.Code()
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// MarshalJSON encodes the result.
+func (b BulkResult) MarshalJSON() ([]byte, error) {
+	succeeded, failed := b.Succeeded, b.Failed
+	if succeeded == nil {
+		succeeded = []ItemResult{}
+	}
+	if failed == nil {
+		failed = []ItemResult{}
+	}
+	return json.Marshal(map[string]interface{}{
+		"succeeded": succeeded,
+		"failed":    failed,
+	})
+}
+
+// Succeed appends an item that succeeded with the result data, which may be
+// nil.
+func (b *BulkResult) Succeed(id, data interface{}) *BulkResult {
+	b.Succeeded = append(b.Succeeded, ItemResult{ID: id, Data: data})
+	return b
+}
+
+// Fail appends an item that failed with err.
+func (b *BulkResult) Fail(id interface{}, err error) *BulkResult {
+	b.Failed = append(b.Failed, ItemResult{ID: id, Err: err})
+	return b
+}
@@ -6,11 +6,16 @@
 package json
 
 import (
+	"bytes"
+	"crypto/hmac"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"strings"
 )
 
 // ----------------------------------------------------------------------------
@@ -19,27 +24,41 @@ import (
 
 // clientRequest represents a JSON-RPC request sent by a client.
 type clientRequest struct {
+	// The name of the action (service) that provides the method.
+	Action string `json:"action"`
 	// A String containing the name of the method to be invoked.
 	Method string `json:"method"`
 	// Object to pass as request parameter to the method.
-	Params [1]interface{} `json:"params"`
+	Params [1]interface{} `json:"data"`
+	// The request type, always "rpc" for remoting calls.
+	Type string `json:"type"`
 	// The request id. This can be of any type. It is used to match the
 	// response with the request that it is replying to.
-	Id uint64 `json:"id"`
+	Id uint64 `json:"tid"`
 }
 
 // clientResponse represents a JSON-RPC response returned to a client.
 type clientResponse struct {
-	Result *json.RawMessage `json:"result"`
-	Error  interface{}      `json:"error"`
-	Id     uint64           `json:"id"`
+	Result  *json.RawMessage `json:"result"`
+	Message interface{}      `json:"message"`
+	Type    string           `json:"type"`
+	Id      uint64           `json:"tid"`
 }
 
 // EncodeClientRequest encodes parameters for a JSON-RPC client request.
+//
+// The method uses a dotted notation as in "Service.Method"; the part before
+// the last dot is sent as the action.
 func EncodeClientRequest(method string, args interface{}) ([]byte, error) {
+	var action string
+	if i := strings.LastIndex(method, "."); i != -1 {
+		action, method = method[:i], method[i+1:]
+	}
 	c := &clientRequest{
+		Action: action,
 		Method: method,
 		Params: [1]interface{}{args},
+		Type:   "rpc",
 		Id:     uint64(rand.Int63()),
 	}
 	return json.Marshal(c)
@@ -52,11 +71,47 @@ func DecodeClientResponse(r io.Reader, reply interface{}) error {
 	if err := json.NewDecoder(r).Decode(&c); err != nil {
 		return err
 	}
-	if c.Error != nil {
-		return fmt.Errorf("%v", c.Error)
+	if c.Type == "exception" {
+		return fmt.Errorf("%v", c.Message)
 	}
 	if c.Result == nil {
 		return errors.New("result is null")
 	}
 	return json.Unmarshal(*c.Result, reply)
 }
+
+// ErrBadSignature is returned by DecodeSignedClientResponse when the
+// signature of a response does not match its body.
+var ErrBadSignature = errors.New("rpc: response signature does not match its body")
+
+// DecodeSignedClientResponse is like DecodeClientResponse for responses
+// signed with WithResponseSigning. signature is the value of the
+// X-RPC-Signature response header and key the key of the server. It returns
+// ErrBadSignature without decoding the response if the signature does not
+// match the body.
+func DecodeSignedClientResponse(r io.Reader, signature string, key []byte, reply interface{}) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(signature), []byte(signBody(key, body))) {
+		return ErrBadSignature
+	}
+	return DecodeClientResponse(bytes.NewReader(body), reply)
+}
+
+// DecodeSignedHTTPResponse is like DecodeSignedClientResponse for the
+// response resp, whose body it reads. The signature is taken from the
+// X-RPC-Signature header or, for streamed responses, from the trailer of
+// the same name.
+func DecodeSignedHTTPResponse(resp *http.Response, key []byte, reply interface{}) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	signature := resp.Header.Get(signatureHeader)
+	if signature == "" {
+		signature = resp.Trailer.Get(signatureHeader)
+	}
+	return DecodeSignedClientResponse(bytes.NewReader(body), signature, key, reply)
+}
@@ -0,0 +1,54 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"net/http"
+	"sync"
+)
+
+// coalescer shares the response of a call in flight with the identical
+// calls made before it completes. Unlike dedupe, responses are forgotten as
+// soon as the call completes.
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*dedupeCall
+}
+
+// serve answers r with the response of an identical call in flight if
+// there is one, waiting for it to complete. Otherwise it dispatches r.
+func (co *coalescer) serve(w http.ResponseWriter, r *http.Request, req *serverRequest, dispatch http.HandlerFunc) {
+	var data []byte
+	if req.Params != nil {
+		data = *req.Params
+	}
+	key := DefaultDedupeKey(r, req.Action, req.Method, data)
+	if key == "" {
+		dispatch(w, r)
+		return
+	}
+	co.mu.Lock()
+	if call, ok := co.calls[key]; ok {
+		co.mu.Unlock()
+		<-call.done
+		call.res.writeTo(w, req.Id)
+		return
+	}
+	if co.calls == nil {
+		co.calls = make(map[string]*dedupeCall)
+	}
+	call := &dedupeCall{done: make(chan struct{}), res: newResponseBuffer()}
+	co.calls[key] = call
+	co.mu.Unlock()
+
+	defer func() {
+		co.mu.Lock()
+		delete(co.calls, key)
+		co.mu.Unlock()
+		close(call.done)
+	}()
+	dispatch(call.res, r)
+	call.res.writeTo(w, nil)
+}
@@ -0,0 +1,101 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// callState holds the values of a call shared between the codec and the
+// method through the request context.
+type callState struct {
+	mu           sync.Mutex
+	lastModified time.Time
+	deprecations []Deprecation
+	// captureStack tells NewStackError to record stacks, in debug mode
+	// with stack capture enabled.
+	captureStack bool
+}
+
+type callStateKey struct{}
+
+// withCallState stores a new call state in the context of r and returns it.
+func withCallState(r *http.Request) *callState {
+	st := new(callState)
+	setContext(r, context.WithValue(r.Context(), callStateKey{}, st))
+	return st
+}
+
+// callStateFromContext returns the call state of ctx, or nil if ctx is not
+// the context of a call.
+func callStateFromContext(ctx context.Context) *callState {
+	st, _ := ctx.Value(callStateKey{}).(*callState)
+	return st
+}
+
+// SetLastModified sets the modification time of the data returned by the
+// call of ctx, the request context passed to the method. For methods
+// classified as reads in the registry, the codec writes it as the
+// Last-Modified header and answers requests whose If-Modified-Since is not
+// older with 304 Not Modified and no body. It is ignored for writes.
+func SetLastModified(ctx context.Context, t time.Time) {
+	if st := callStateFromContext(ctx); st != nil {
+		st.mu.Lock()
+		st.lastModified = t
+		st.mu.Unlock()
+	}
+}
+
+// notModified sets the Last-Modified header of w from st and reports
+// whether r already has the data, as told by its If-Modified-Since header.
+func (st *callState) notModified(w http.ResponseWriter, r *http.Request) bool {
+	st.mu.Lock()
+	t := st.lastModified
+	st.mu.Unlock()
+	if t.IsZero() {
+		return false
+	}
+	t = t.UTC().Truncate(time.Second)
+	w.Header().Set("Last-Modified", t.Format(http.TimeFormat))
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !t.After(since)
+}
+
+// Deprecation is a notice about a deprecated field of the data of a call,
+// returned under meta.deprecations with WithDeprecationNotices.
+type Deprecation struct {
+	// Field is the deprecated field, such as "sort" or "filter.op".
+	Field string `json:"field"`
+	// Message tells clients how to migrate.
+	Message string `json:"message"`
+}
+
+// Deprecate records that the call of ctx, the request context passed to
+// the method, used the deprecated field. Fields recorded several times get
+// a single notice.
+func Deprecate(ctx context.Context, field, message string) {
+	if st := callStateFromContext(ctx); st != nil {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		for _, d := range st.deprecations {
+			if d.Field == field {
+				return
+			}
+		}
+		st.deprecations = append(st.deprecations, Deprecation{Field: field, Message: message})
+	}
+}
+
+// takeDeprecations returns the notices recorded for the call.
+func (st *callState) takeDeprecations() []Deprecation {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	d := st.deprecations
+	st.deprecations = nil
+	return d
+}
@@ -0,0 +1,67 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+type correlationIDKey struct{}
+
+// CorrelationIDFromContext returns the correlation id extracted from the
+// data of the call, if the codec uses WithCorrelationPath and the data
+// holds one.
+func CorrelationIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(correlationIDKey{}).(string)
+	return id, ok
+}
+
+// extractPath returns the value at path in the JSON document data, as a
+// string: strings are unquoted and other scalars are kept as encoded. ok
+// is false if the path does not exist or leads to an object, an array or
+// null. path is a dot separated list of object keys and array indexes.
+func extractPath(data json.RawMessage, path string) (value string, ok bool) {
+	for _, key := range strings.Split(path, ".") {
+		if i, err := strconv.Atoi(key); err == nil {
+			var elems []json.RawMessage
+			if json.Unmarshal(data, &elems) != nil || i < 0 || i >= len(elems) {
+				return "", false
+			}
+			data = elems[i]
+			continue
+		}
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(data, &fields) != nil {
+			return "", false
+		}
+		if data, ok = fields[key]; !ok {
+			return "", false
+		}
+	}
+	var v interface{}
+	if json.Unmarshal(data, &v) != nil {
+		return "", false
+	}
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64, bool:
+		return string(data), true
+	}
+	return "", false
+}
+
+// logf logs a message about the call of c, tagged with its correlation id
+// if it has one.
+func (c *CodecRequest) logf(format string, v ...interface{}) {
+	if c.correlationID != "" {
+		format += " (correlation id %s)"
+		v = append(v, c.correlationID)
+	}
+	c.codec.logf(format, v...)
+}
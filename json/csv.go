@@ -0,0 +1,49 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"encoding/csv"
+	"net/http"
+)
+
+// formatHeader is the request header used to ask for an alternate response
+// format. The only supported value is "csv".
+const formatHeader = "X-RPC-Format"
+
+// CSVExporter is implemented by replies that can be exported as CSV.
+//
+// A method reply is exported instead of being encoded as JSON when the
+// request sets the "X-RPC-Format: csv" header, the method is marked as CSV
+// in the registry and the method returned no error.
+type CSVExporter interface {
+	// ExportCSV writes the reply as CSV records, a header row first.
+	ExportCSV(w *csv.Writer) error
+}
+
+// exportsCSV reports whether reply must be written as CSV.
+func (c *CodecRequest) exportsCSV(reply interface{}) bool {
+	if c.format != "csv" {
+		return false
+	}
+	m := c.spec()
+	if m == nil || !m.CSV {
+		return false
+	}
+	_, ok := reply.(CSVExporter)
+	return ok
+}
+
+// writeCSV streams the records of e to w as an attachment named filename.
+func writeCSV(w http.ResponseWriter, filename string, e CSVExporter) error {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", contentDisposition(filename))
+	cw := csv.NewWriter(w)
+	if err := e.ExportCSV(cw); err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
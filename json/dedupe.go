@@ -0,0 +1,178 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DedupeKeyFunc returns the key identifying identical calls for
+// deduplication. Calls with an empty key are never deduplicated.
+type DedupeKeyFunc func(r *http.Request, action, method string, data []byte) string
+
+// DefaultDedupeKey identifies calls by principal, action, method and data.
+// Calls without a principal get an empty key, as nothing tells their
+// callers apart: deduplicating anonymous calls takes a key function that
+// identifies the caller, for example by session.
+func DefaultDedupeKey(r *http.Request, action, method string, data []byte) string {
+	p, ok := PrincipalFromContext(r.Context())
+	if !ok || p == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v\x00%s\x00%s\x00%s", p, action, method, data)
+}
+
+// dedupe remembers the responses of recent calls so that identical calls
+// made within the window are answered without being dispatched again.
+type dedupe struct {
+	window time.Duration
+	key    DedupeKeyFunc
+
+	mu        sync.Mutex
+	calls     map[string]*dedupeCall
+	lastSweep time.Time
+}
+
+// dedupeCall is a call seen by dedupe. done is closed once res is set.
+type dedupeCall struct {
+	start time.Time
+	done  chan struct{}
+	res   *responseBuffer
+}
+
+func newDedupe(window time.Duration, key DedupeKeyFunc) *dedupe {
+	if key == nil {
+		key = DefaultDedupeKey
+	}
+	return &dedupe{
+		window: window,
+		key:    key,
+		calls:  make(map[string]*dedupeCall),
+	}
+}
+
+// serve answers r with the response of an identical recent call if there
+// is one, waiting for it to complete if needed. Otherwise it dispatches r
+// and remembers the response. If ack is not nil it answers the replays of
+// successful calls instead.
+func (d *dedupe) serve(w http.ResponseWriter, r *http.Request, req *serverRequest, dispatch http.HandlerFunc, ack func(http.ResponseWriter, *serverRequest)) {
+	var data []byte
+	if req.Params != nil {
+		data = *req.Params
+	}
+	key := d.key(r, req.Action, req.Method, data)
+	if key == "" {
+		dispatch(w, r)
+		return
+	}
+	now := time.Now()
+	d.mu.Lock()
+	if now.Sub(d.lastSweep) > d.window {
+		for k, call := range d.calls {
+			if now.Sub(call.start) > d.window {
+				delete(d.calls, k)
+			}
+		}
+		d.lastSweep = now
+	}
+	call, ok := d.calls[key]
+	if ok && now.Sub(call.start) <= d.window {
+		d.mu.Unlock()
+		<-call.done
+		if ack != nil && call.res.succeeded() {
+			ack(w, req)
+			return
+		}
+		call.res.writeTo(w, req.Id)
+		return
+	}
+	call = &dedupeCall{start: now, done: make(chan struct{})}
+	d.calls[key] = call
+	d.mu.Unlock()
+
+	call.res = newResponseBuffer()
+	defer close(call.done)
+	dispatch(call.res, r)
+	call.res.writeTo(w, nil)
+}
+
+// ----------------------------------------------------------------------------
+// responseBuffer
+// ----------------------------------------------------------------------------
+
+// responseBuffer is an http.ResponseWriter keeping the response in memory.
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   []byte
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: make(http.Header), status: http.StatusOK}
+}
+
+// Header implements http.ResponseWriter.
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+// Write implements http.ResponseWriter.
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	b.body = append(b.body, p...)
+	return len(p), nil
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (b *responseBuffer) WriteHeader(status int) {
+	b.status = status
+}
+
+// succeeded reports whether the buffered response holds a result envelope.
+func (b *responseBuffer) succeeded() bool {
+	var env struct {
+		Type string `json:"type"`
+	}
+	return b.status >= 200 && b.status < 300 && json.Unmarshal(b.body, &env) == nil &&
+		env.Type != "" && env.Type != "exception"
+}
+
+// writeTo copies the buffered response to w. If id is not nil it replaces
+// the tid of the buffered envelope. The request id already set on w is
+// kept, so that a response shared with other calls carries the id of each
+// caller.
+func (b *responseBuffer) writeTo(w http.ResponseWriter, id *json.RawMessage) {
+	_, own := w.Header()[requestIDHeader]
+	for k, v := range b.header {
+		if k == requestIDHeader && own {
+			continue
+		}
+		w.Header()[k] = v
+	}
+	w.WriteHeader(b.status)
+	w.Write(replaceTid(b.body, id))
+}
+
+// replaceTid returns body with the tid of the envelope it holds replaced
+// by id. body is returned unchanged if id is nil or body is not a JSON
+// object.
+func replaceTid(body []byte, id *json.RawMessage) []byte {
+	if id == nil {
+		return body
+	}
+	var fields map[string]*json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body
+	}
+	fields["tid"] = id
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return body
+	}
+	return append(b, '\n')
+}
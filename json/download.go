@@ -0,0 +1,104 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DownloadResult is a method reply streamed to the client as a file
+// attachment instead of being encoded as JSON.
+//
+// A method returns a download by using *DownloadResult as its reply type
+// and filling it in.
+type DownloadResult struct {
+	// Name is the file name suggested to the client.
+	Name string
+	// ContentType is the media type of the file. It defaults to
+	// "application/octet-stream".
+	ContentType string
+	// Reader provides the file contents. It is closed once the call is
+	// answered if it implements io.Closer, also when the method returns an
+	// error.
+	Reader io.Reader
+}
+
+// close closes the reader of d if it implements io.Closer.
+func (d *DownloadResult) close() {
+	if c, ok := d.Reader.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// writeDownload streams d to w. Once part of the file was written the
+// response can no longer be replaced by an error: a failure is then only
+// logged and the rest of the file is dropped.
+func (c *Codec) writeDownload(w http.ResponseWriter, d *DownloadResult) error {
+	contentType := d.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", contentDisposition(d.Name))
+	if d.Reader == nil {
+		return nil
+	}
+	sw := &streamWriter{w: w}
+	if _, err := io.Copy(sw, d.Reader); err != nil {
+		if sw.wrote {
+			c.logf("rpc: download of %q aborted: %v", d.Name, err)
+			return nil
+		}
+		w.Header().Del("Content-Disposition")
+		return err
+	}
+	return nil
+}
+
+// streamWriter writes to w, flushing it after the first write so that
+// writers buffering responses, such as the signing one, stream the rest of
+// the body.
+type streamWriter struct {
+	w     http.ResponseWriter
+	wrote bool
+}
+
+// Write implements io.Writer.
+func (s *streamWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	if !s.wrote {
+		s.wrote = true
+		if f, ok := s.w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	return n, err
+}
+
+// contentDisposition returns an attachment Content-Disposition header value
+// for filename, as described in RFC 6266.
+//
+// The filename parameter holds an ASCII fallback. Names with non-ASCII
+// characters are also sent UTF-8 encoded in the filename* parameter.
+func contentDisposition(filename string) string {
+	ascii := true
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r >= 0x7f {
+			ascii = false
+			return '_'
+		}
+		return r
+	}, filename)
+	fallback = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(fallback)
+	v := fmt.Sprintf(`attachment; filename="%s"`, fallback)
+	if !ascii {
+		v += "; filename*=UTF-8''" + strings.Replace(url.QueryEscape(filename), "+", "%20", -1)
+	}
+	return v
+}
@@ -0,0 +1,319 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// errCyclicResult is returned for results referencing themselves.
+var errCyclicResult = errors.New("rpc: result cannot be encoded: cyclic value")
+
+// enumName is a json.Marshaler writing an enum value as its name.
+type enumName struct {
+	fmt.Stringer
+}
+
+// MarshalJSON implements json.Marshaler.
+func (e enumName) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.String())
+}
+
+// enumStruct is a json.Marshaler writing the members of an encoded struct
+// in order, the values of its enum fields replaced by their names.
+type enumStruct struct {
+	keys   []string
+	values []interface{}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s enumStruct) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range s.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		value, err := json.Marshal(s.values[i])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+var typeOfInterface = reflect.TypeOf((*interface{})(nil)).Elem()
+
+// enumNames returns reply with the values of the enum types of the codec
+// wrapped in enumName, as set by WithEnumStrings. The reply itself and the
+// elements of the pointers, slices, arrays, maps, interfaces and struct
+// fields it is made of are wrapped.
+func (c *Codec) enumNames(reply interface{}) (interface{}, error) {
+	v, _, err := c.wrapEnums(reflect.ValueOf(reply), make(map[uintptr]bool))
+	if err != nil || !v.IsValid() {
+		return reply, err
+	}
+	return v.Interface(), nil
+}
+
+// wrapEnums returns v with its enum values wrapped, and whether it holds
+// any. seen holds the pointers, slices and maps being wrapped, to detect
+// cycles.
+func (c *Codec) wrapEnums(v reflect.Value, seen map[uintptr]bool) (reflect.Value, bool, error) {
+	if !v.IsValid() || !v.CanInterface() {
+		// Values reached through unexported fields are left to
+		// encoding/json.
+		return v, false, nil
+	}
+	if c.enums[v.Type()] {
+		return reflect.ValueOf(enumName{v.Interface().(fmt.Stringer)}), true, nil
+	}
+	if v.Kind() != reflect.Interface && !c.holdsEnums(v.Type(), make(map[reflect.Type]bool)) {
+		return v, false, nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map:
+		if v.IsNil() {
+			return v, false, nil
+		}
+		p := v.Pointer()
+		if seen[p] {
+			return v, false, errCyclicResult
+		}
+		seen[p] = true
+		defer delete(seen, p)
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return v, false, nil
+		}
+		return c.wrapEnums(v.Elem(), seen)
+	case reflect.Slice, reflect.Array:
+		s := make([]interface{}, v.Len())
+		wrapped := false
+		for i := range s {
+			e, ok, err := c.wrapEnums(v.Index(i), seen)
+			if err != nil {
+				return v, false, err
+			}
+			s[i], wrapped = e.Interface(), wrapped || ok
+		}
+		if !wrapped {
+			return v, false, nil
+		}
+		return reflect.ValueOf(s), true, nil
+	case reflect.Map:
+		// The keys keep their type so that encoding/json writes them.
+		m := reflect.MakeMap(reflect.MapOf(v.Type().Key(), typeOfInterface))
+		wrapped := false
+		for _, k := range v.MapKeys() {
+			e, ok, err := c.wrapEnums(v.MapIndex(k), seen)
+			if err != nil {
+				return v, false, err
+			}
+			m.SetMapIndex(k, e)
+			wrapped = wrapped || ok
+		}
+		if !wrapped {
+			return v, false, nil
+		}
+		return m, true, nil
+	case reflect.Struct:
+		return c.wrapStruct(v, seen)
+	}
+	return v, false, nil
+}
+
+// wrapStruct returns the struct v as an enumStruct holding the members
+// encoding/json writes for it, with the values of its enum fields wrapped.
+func (c *Codec) wrapStruct(v reflect.Value, seen map[uintptr]bool) (reflect.Value, bool, error) {
+	fields := make(map[string]interface{})
+	for name, f := range c.enumFields(v) {
+		e, ok, err := c.wrapEnums(f, seen)
+		if err != nil {
+			return v, false, err
+		}
+		if ok {
+			fields[name] = e.Interface()
+		}
+	}
+	if len(fields) == 0 {
+		return v, false, nil
+	}
+	b, err := json.Marshal(v.Interface())
+	if err != nil {
+		return v, false, err
+	}
+	// Keep the members in order, replacing those of the enum fields.
+	var s enumStruct
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if _, err := dec.Token(); err != nil {
+		return v, false, err
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return v, false, err
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return v, false, err
+		}
+		key := t.(string)
+		s.keys = append(s.keys, key)
+		if e, ok := fields[key]; ok {
+			s.values = append(s.values, e)
+		} else {
+			s.values = append(s.values, value)
+		}
+	}
+	return reflect.ValueOf(s), true, nil
+}
+
+// structField is a field of a struct, or of the structs it embeds, as
+// written by encoding/json. value is not valid for fields that are written
+// as they are.
+type structField struct {
+	name   string
+	depth  int
+	tagged bool
+	value  reflect.Value
+}
+
+// enumFields returns the fields of the struct v that may hold enums, by the
+// name encoding/json writes them under. Fields encoding/json ignores, and
+// fields with the string tag option, are left out. As with encoding/json,
+// promoted fields are hidden by shallower fields of the same name, and
+// fields of the same name at the same depth hide each other unless a
+// single one of them is tagged.
+func (c *Codec) enumFields(v reflect.Value) map[string]reflect.Value {
+	var fields []structField
+	level := []reflect.Value{v}
+	for depth := 0; len(level) > 0; depth++ {
+		var next []reflect.Value
+		for _, s := range level {
+			t := s.Type()
+			for i := 0; i < t.NumField(); i++ {
+				sf := t.Field(i)
+				tag := sf.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				opts := strings.Split(tag, ",")
+				f := structField{name: opts[0], depth: depth, tagged: opts[0] != "", value: s.Field(i)}
+				if sf.Anonymous && !f.tagged {
+					if e := f.value; indirectType(sf.Type).Kind() == reflect.Struct {
+						if e.Kind() == reflect.Ptr {
+							if e.IsNil() {
+								continue
+							}
+							e = e.Elem()
+						}
+						next = append(next, e)
+						continue
+					}
+				}
+				if sf.PkgPath != "" {
+					continue
+				}
+				if !f.tagged {
+					f.name = sf.Name
+				}
+				for _, opt := range opts[1:] {
+					if opt == "string" {
+						f.value = reflect.Value{}
+					}
+				}
+				fields = append(fields, f)
+			}
+		}
+		level = next
+	}
+
+	byName := make(map[string][]structField)
+	for _, f := range fields {
+		byName[f.name] = append(byName[f.name], f)
+	}
+	enums := make(map[string]reflect.Value)
+	for name, fs := range byName {
+		// fs is sorted by depth: keep the dominant field, if any.
+		var dominant, tagged []structField
+		for _, f := range fs {
+			if f.depth == fs[0].depth {
+				dominant = append(dominant, f)
+				if f.tagged {
+					tagged = append(tagged, f)
+				}
+			}
+		}
+		if len(dominant) > 1 {
+			dominant = tagged
+		}
+		if len(dominant) == 1 && dominant[0].value.IsValid() &&
+			c.holdsEnums(dominant[0].value.Type(), make(map[reflect.Type]bool)) {
+			enums[name] = dominant[0].value
+		}
+	}
+	return enums
+}
+
+// indirectType returns the element type of t if it is a pointer, or t.
+func indirectType(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+	return t
+}
+
+// holdsEnums reports whether values of type t may hold enum values that
+// wrapEnums wraps. Types with their own JSON encoding are written as they
+// encode themselves.
+func (c *Codec) holdsEnums(t reflect.Type, visiting map[reflect.Type]bool) bool {
+	if c.enums[t] {
+		return true
+	}
+	if visiting[t] || encodesItself(t) {
+		return false
+	}
+	visiting[t] = true
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return c.holdsEnums(t.Elem(), visiting)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if sf := t.Field(i); (sf.PkgPath == "" || sf.Anonymous) && c.holdsEnums(sf.Type, visiting) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var (
+	typeOfMarshaler     = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	typeOfTextMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// encodesItself reports whether values of type t, or pointers to them,
+// implement json.Marshaler or encoding.TextMarshaler.
+func encodesItself(t reflect.Type) bool {
+	p := reflect.PtrTo(t)
+	return t.Implements(typeOfMarshaler) || t.Implements(typeOfTextMarshaler) ||
+		p.Implements(typeOfMarshaler) || p.Implements(typeOfTextMarshaler)
+}
@@ -0,0 +1,85 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrorRecord describes an exception written by a codec.
+type ErrorRecord struct {
+	Action  string    `json:"action"`
+	Method  string    `json:"method"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+	Code    string    `json:"code,omitempty"`
+}
+
+// errorLog is a ring buffer of the most recent exceptions.
+type errorLog struct {
+	mu      sync.Mutex
+	records []ErrorRecord
+	// next is the index of the slot the next record goes to.
+	next int
+	full bool
+}
+
+// add records the exception env.
+func (l *errorLog) add(env *Envelope) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records[l.next] = ErrorRecord{
+		Action:  env.Action,
+		Method:  env.Method,
+		Time:    time.Now(),
+		Message: fmt.Sprint(env.Message),
+		Code:    env.Code,
+	}
+	l.next = (l.next + 1) % len(l.records)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// list returns the records, oldest first.
+func (l *errorLog) list() []ErrorRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]ErrorRecord(nil), l.records[:l.next]...)
+	}
+	return append(append([]ErrorRecord(nil), l.records[l.next:]...), l.records[:l.next]...)
+}
+
+// RecentErrors returns the most recent exceptions written by the codec,
+// oldest first, if it uses WithRecentErrors.
+func (c *Codec) RecentErrors() []ErrorRecord {
+	if c.recentErrors == nil {
+		return nil
+	}
+	return c.recentErrors.list()
+}
+
+// RecentErrorsHandler returns a handler serving RecentErrors as JSON, for
+// live troubleshooting. It answers 404 Not Found unless the codec is in
+// debug mode.
+func (c *Codec) RecentErrorsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.debug {
+			http.NotFound(w, r)
+			return
+		}
+		records := c.RecentErrors()
+		if records == nil {
+			records = []ErrorRecord{}
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(records)
+	})
+}
@@ -0,0 +1,185 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+// ErrContentLength is returned in strict content length mode when the
+// request body does not match its declared Content-Length, which usually
+// means it was truncated.
+var ErrContentLength = errors.New("rpc: request body does not match its Content-Length")
+
+// ErrMaintenance is the exception returned by a Router that is not
+// accepting new calls. Its code is "maintenance".
+var ErrMaintenance error = &codedError{
+	message: "rpc: server is in maintenance, try again later",
+	code:    "maintenance",
+}
+
+// ReauthError is returned by methods when the session of the caller has
+// expired. It is written as an exception with code "reauth", telling the
+// client to authenticate again.
+type ReauthError struct {
+	Message string
+}
+
+// NewReauthError returns a ReauthError with the given message.
+func NewReauthError(message string) *ReauthError {
+	return &ReauthError{Message: message}
+}
+
+// Error implements the error interface.
+func (e *ReauthError) Error() string {
+	if e.Message == "" {
+		return "session expired"
+	}
+	return e.Message
+}
+
+// Code returns the exception code, "reauth".
+func (e *ReauthError) Code() string {
+	return "reauth"
+}
+
+// StackError is an error annotated with the stack where it was created.
+// In debug mode its exception carries the stack under "where".
+type StackError struct {
+	Err error
+	pcs []uintptr
+}
+
+// NewStackError returns err, which must not be nil, annotated with the
+// stack of the caller. ctx is the request context passed to the method:
+// the stack is only recorded for the calls of codecs in debug mode with
+// stack capture enabled, so that errors cost no more than err otherwise.
+// Only the program counters are recorded; the stack is formatted when
+// written.
+func NewStackError(ctx context.Context, err error) *StackError {
+	e := &StackError{Err: err}
+	if st := callStateFromContext(ctx); st != nil && st.captureStack {
+		pcs := make([]uintptr, 32)
+		e.pcs = pcs[:runtime.Callers(2, pcs)]
+	}
+	return e
+}
+
+// Error implements the error interface.
+func (e *StackError) Error() string {
+	return e.Err.Error()
+}
+
+// Code returns the exception code of the annotated error, if any.
+func (e *StackError) Code() string {
+	if c, ok := e.Err.(coder); ok {
+		return c.Code()
+	}
+	return ""
+}
+
+// Stack returns the stack where e was created, a function and its
+// position per frame, or an empty string if it was not recorded.
+func (e *StackError) Stack() string {
+	if len(e.pcs) == 0 {
+		return ""
+	}
+	var b bytes.Buffer
+	frames := runtime.CallersFrames(e.pcs)
+	for {
+		f, more := frames.Next()
+		fmt.Fprintf(&b, "%s()\n\t%s:%d\n", f.Function, f.File, f.Line)
+		if !more {
+			return b.String()
+		}
+	}
+}
+
+// stacker is implemented by errors that carry the stack where they were
+// created.
+type stacker interface {
+	Stack() string
+}
+
+// coder is implemented by errors that carry an exception code.
+type coder interface {
+	Code() string
+}
+
+// ErrBusy is the exception returned when a call is rejected because too
+// many calls are being served. Its code is "busy".
+var ErrBusy error = &codedError{
+	message: "rpc: server busy, try again later",
+	code:    "busy",
+}
+
+// ErrTimeout is the exception answering a call that did not complete
+// within the call timeout. Its code is "timeout".
+var ErrTimeout error = &codedError{
+	message: "rpc: call timed out",
+	code:    "timeout",
+}
+
+// ErrDataTooLarge is the exception answering calls whose encoded data
+// exceeds the MaxDataSize of their method. Its code is "too_large".
+var ErrDataTooLarge error = &codedError{
+	message: "rpc: request data too large",
+	code:    "too_large",
+}
+
+// ErrFieldTooLarge is the exception answering form posts with a field
+// larger than the limit set by WithMaxFieldSize. Its code is "too_large".
+var ErrFieldTooLarge error = &codedError{
+	message: "rpc: form field too large",
+	code:    "too_large",
+}
+
+// ErrWriteMethod is the exception answering GET requests calling a method
+// not classified as a read. Its code is "method_not_allowed".
+var ErrWriteMethod error = &codedError{
+	message: "rpc: method is not a read and must be called with POST",
+	code:    "method_not_allowed",
+}
+
+// ErrClockSkew is the exception answering requests whose timestamp is
+// outside the tolerance set by WithTimestampTolerance. Its code is
+// "clock_skew".
+var ErrClockSkew error = &codedError{
+	message: "rpc: request timestamp is too far from the server time",
+	code:    "clock_skew",
+}
+
+// ErrHeaderTooLarge is the exception answering requests whose headers
+// exceed the limit set by WithMaxHeaderBytes. Its code is
+// "header_too_large".
+var ErrHeaderTooLarge error = &codedError{
+	message: "rpc: request headers too large",
+	code:    "header_too_large",
+}
+
+// ErrInsecureTransport is the exception answering plaintext requests
+// rejected by RequireTLS. Its code is "insecure".
+var ErrInsecureTransport error = &codedError{
+	message: "rpc: plaintext requests are not accepted, use https",
+	code:    "insecure",
+}
+
+// codedError is an error with an exception code.
+type codedError struct {
+	message string
+	code    string
+}
+
+func (e *codedError) Error() string {
+	return e.message
+}
+
+func (e *codedError) Code() string {
+	return e.code
+}
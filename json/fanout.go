@@ -0,0 +1,49 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"sync"
+	"time"
+)
+
+// fanOut is a token bucket limiting the calls dispatched from batches.
+type fanOut struct {
+	mu     sync.Mutex
+	limit  float64
+	per    time.Duration
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// newFanOut returns a bucket allowing limit calls per period.
+func newFanOut(limit int, per time.Duration) *fanOut {
+	return &fanOut{
+		limit:  float64(limit),
+		per:    per,
+		tokens: float64(limit),
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+// take reserves n calls from the budget. It reports false, reserving
+// nothing, if the budget cannot cover all of them.
+func (f *fanOut) take(n int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.now()
+	f.tokens += f.limit * float64(now.Sub(f.last)) / float64(f.per)
+	if f.tokens > f.limit {
+		f.tokens = f.limit
+	}
+	f.last = now
+	if float64(n) > f.tokens {
+		return false
+	}
+	f.tokens -= float64(n)
+	return true
+}
@@ -0,0 +1,56 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// formatFloats rewrites the fractional and exponent numbers of the JSON
+// document b in non-exponential notation with prec decimal places, or the
+// fewest needed to represent them exactly if prec is negative. Integers
+// and strings are left untouched.
+func formatFloats(b []byte, prec int) []byte {
+	var out bytes.Buffer
+	out.Grow(len(b))
+	for i := 0; i < len(b); {
+		switch c := b[i]; {
+		case c == '"':
+			j := i + 1
+			for j < len(b) && b[j] != '"' {
+				if b[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j < len(b) {
+				j++
+			}
+			out.Write(b[i:j])
+			i = j
+		case c == '-' || (c >= '0' && c <= '9'):
+			j := i + 1
+			float := false
+			for j < len(b) && strings.IndexByte("0123456789.eE+-", b[j]) != -1 {
+				if b[j] == '.' || b[j] == 'e' || b[j] == 'E' {
+					float = true
+				}
+				j++
+			}
+			if v, err := strconv.ParseFloat(string(b[i:j]), 64); float && err == nil {
+				out.WriteString(strconv.FormatFloat(v, 'f', prec, 64))
+			} else {
+				out.Write(b[i:j])
+			}
+			i = j
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,245 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// FormResult is the reply of form handler methods, in the shape ExtJS
+// forms expect from a submit: {success, data, errors, warnings}.
+//
+// Errors reject the submit and are displayed on their fields. Warnings are
+// non-fatal messages shown while the submit still succeeds.
+type FormResult struct {
+	Success bool
+	// Data is the optional payload returned to the form.
+	Data interface{}
+	// Errors maps field names to error messages.
+	Errors map[string]string
+	// Warnings maps field names to warning messages.
+	Warnings map[string]string
+}
+
+// MarshalJSON encodes the result, omitting empty data, errors and warnings.
+func (f FormResult) MarshalJSON() ([]byte, error) {
+	fields := map[string]interface{}{"success": f.Success}
+	if f.Data != nil {
+		fields["data"] = f.Data
+	}
+	if len(f.Errors) > 0 {
+		fields["errors"] = f.Errors
+	}
+	if len(f.Warnings) > 0 {
+		fields["warnings"] = f.Warnings
+	}
+	return json.Marshal(fields)
+}
+
+// defaultFormMemory is the number of bytes of a multipart form kept in
+// memory, the rest of the files being stored on disk.
+const defaultFormMemory = 32 << 20
+
+// isForm reports whether r is an ExtDirect form post rather than a JSON
+// request.
+func isForm(r *http.Request) bool {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return ct == "multipart/form-data" || ct == "application/x-www-form-urlencoded"
+}
+
+// acquireUpload takes one of the upload slots of the codec for the
+// multipart post r, as set by WithUploadLimit. ok is false if all slots
+// are taken, in which case the post must be rejected without reading its
+// body. Otherwise release must be called once the body was read. Posts
+// that are not multipart and forms already parsed take no slot.
+func (c *Codec) acquireUpload(r *http.Request) (release func(), ok bool) {
+	if c.uploadSlots == nil || r.MultipartForm != nil {
+		return func() {}, true
+	}
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "multipart/form-data" {
+		return func() {}, true
+	}
+	select {
+	case c.uploadSlots <- struct{}{}:
+		return func() { <-c.uploadSlots }, true
+	default:
+		return nil, false
+	}
+}
+
+// formKeys are the form fields describing the call rather than its data.
+var formKeys = map[string]bool{
+	"extAction": true,
+	"extMethod": true,
+	"extTID":    true,
+	"extType":   true,
+	"extUpload": true,
+}
+
+// readForm decodes the ExtDirect form post r into req. The call is
+// described by the extAction, extMethod, extTID and extType fields; the
+// other fields form the single argument object of the method. Uploaded
+// files are left in r.MultipartForm for the method to read. It reports
+// whether the post is an upload, whose response must be wrapped in HTML.
+func readForm(r *http.Request, req *serverRequest) (upload bool, err error) {
+	if err := r.ParseMultipartForm(defaultFormMemory); err != nil && err != http.ErrNotMultipart {
+		return false, err
+	}
+	req.Action = r.PostForm.Get("extAction")
+	req.Method = r.PostForm.Get("extMethod")
+	req.Type = r.PostForm.Get("extType")
+	if tid := r.PostForm.Get("extTID"); tid != "" {
+		var id json.RawMessage
+		if _, err := strconv.ParseUint(tid, 10, 64); err == nil {
+			id = json.RawMessage(tid)
+		} else {
+			id, _ = json.Marshal(tid)
+		}
+		req.Id = &id
+	}
+	fields := make(map[string]interface{})
+	for k, v := range r.PostForm {
+		switch {
+		case formKeys[k]:
+		case len(v) == 1:
+			fields[k] = v[0]
+		default:
+			fields[k] = v
+		}
+	}
+	params, err := json.Marshal([]interface{}{fields})
+	if err != nil {
+		return false, err
+	}
+	raw := json.RawMessage(params)
+	req.Params = &raw
+	return r.PostForm.Get("extUpload") == "true", nil
+}
+
+// limitFields makes the multipart form post r fail as it is parsed if a
+// field other than a file exceeds the field size limit of the codec. The
+// body is copied part by part through a pipe, so that the limit applies
+// while reading instead of once the form is in memory. The returned
+// function must be called once the form was parsed; it reports whether the
+// limit was exceeded.
+func (c *Codec) limitFields(r *http.Request) (done func() (exceeded bool)) {
+	ct, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if c.maxFieldSize <= 0 || ct != "multipart/form-data" || params["boundary"] == "" || r.MultipartForm != nil {
+		return func() bool { return false }
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	mw.SetBoundary(params["boundary"])
+	var exceeded int32
+	go func() {
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				pw.CloseWithError(mw.Close())
+				return
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			dst, err := mw.CreatePart(part.Header)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if part.FileName() != "" {
+				_, err = io.Copy(dst, part)
+			} else {
+				var n int64
+				n, err = io.CopyN(dst, part, c.maxFieldSize+1)
+				if n > c.maxFieldSize {
+					atomic.StoreInt32(&exceeded, 1)
+					err = ErrFieldTooLarge
+				} else if err == io.EOF {
+					err = nil
+				}
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	r.Body = pr
+	return func() bool {
+		// Stop the copy if the form was not read to the end.
+		pr.Close()
+		return atomic.LoadInt32(&exceeded) != 0
+	}
+}
+
+// checkUploads returns an error if a file uploaded with r has a content
+// type not allowed for method m. The type is sniffed from the file
+// contents, ignoring the type declared by the client.
+func checkUploads(r *http.Request, m *Method) error {
+	if m == nil || len(m.UploadTypes) == 0 || r.MultipartForm == nil {
+		return nil
+	}
+	for _, files := range r.MultipartForm.File {
+		for _, fh := range files {
+			ct, err := sniffUpload(fh)
+			if err != nil {
+				return err
+			}
+			if !allowedType(ct, m.UploadTypes) {
+				return fmt.Errorf("rpc: upload %q has disallowed content type %s", fh.Filename, ct)
+			}
+		}
+	}
+	return nil
+}
+
+// sniffUpload returns the media type of an uploaded file, detected from its
+// first bytes.
+func sniffUpload(fh *multipart.FileHeader) (string, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	b := make([]byte, 512)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	ct, _, _ := mime.ParseMediaType(http.DetectContentType(b[:n]))
+	return ct, nil
+}
+
+// allowedType reports whether the media type ct matches one of allowed,
+// which may hold wildcards such as "image/*".
+func allowedType(ct string, allowed []string) bool {
+	for _, a := range allowed {
+		if a == ct || (strings.HasSuffix(a, "/*") && strings.HasPrefix(ct, a[:len(a)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeUploadEnvelope writes the encoded envelope b wrapped in the HTML
+// document ExtDirect expects for uploads, which are posted through a hidden
+// iframe. encoding/json escapes "<", so b cannot close the textarea.
+func writeUploadEnvelope(w http.ResponseWriter, status int, b []byte) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, "<html><body><textarea>")
+	w.Write(b)
+	io.WriteString(w, "</textarea></body></html>")
+}
@@ -0,0 +1,268 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/rpc"
+)
+
+type Avatar struct{}
+
+func (a *Avatar) Upload(r *http.Request, req *struct{ Title string }, res *FormResult) error {
+	f, fh, err := r.FormFile("file")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b, _ := ioutil.ReadAll(f)
+	res.Success = true
+	res.Data = map[string]interface{}{"title": req.Title, "name": fh.Filename, "size": len(b)}
+	return nil
+}
+
+// newUpload returns an ExtDirect upload form post calling Avatar.Upload
+// with a file holding content.
+func newUpload(content string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range map[string]string{
+		"extAction": "Avatar", "extMethod": "Upload", "extTID": "9",
+		"extType": "rpc", "extUpload": "true", "Title": "me",
+	} {
+		mw.WriteField(k, v)
+	}
+	fw, _ := mw.CreateFormFile("file", "avatar.png")
+	fw.Write([]byte(content))
+	mw.Close()
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+// uploadEnvelope extracts the envelope of an upload response.
+func uploadEnvelope(t *testing.T, body string) map[string]interface{} {
+	const prefix, suffix = "<html><body><textarea>", "</textarea></body></html>"
+	if !strings.HasPrefix(body, prefix) || !strings.HasSuffix(body, suffix) {
+		t.Fatalf("Expected an HTML wrapped envelope, but got %q", body)
+	}
+	var env map[string]interface{}
+	if err := json.Unmarshal([]byte(body[len(prefix):len(body)-len(suffix)]), &env); err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func TestUploadTypes(t *testing.T) {
+	reg := NewRegistry()
+	reg.Add("Avatar", "Upload").UploadTypes = []string{"image/png", "image/gif"}
+	codec := NewCodec(WithRegistry(reg), WithMethodValidation())
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "multipart/form-data")
+	s.RegisterService(new(Avatar), "")
+
+	w := serve(s, newUpload("\x89PNG\r\n\x1a\n rest of the image"))
+	env := uploadEnvelope(t, w.Body.String())
+	result, _ := env["result"].(map[string]interface{})
+	data, _ := result["data"].(map[string]interface{})
+	if env["tid"] != 9.0 || result["success"] != true || data["title"] != "me" || data["name"] != "avatar.png" {
+		t.Errorf("Expected accepted upload, but got %v", env)
+	}
+
+	// Through a Router the form is parsed once and validated.
+	w, _ = route(NewRouter(s, codec), newUpload("GIF89a rest of the image"))
+	if env = uploadEnvelope(t, w.Body.String()); env["type"] != "rpc" {
+		t.Errorf("Expected accepted upload through the router, but got %v", env)
+	}
+
+	// The declared file name and type say PNG but the contents are text.
+	w = serve(s, newUpload("just some text"))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), `upload "avatar.png" has disallowed content type text/plain`) {
+		t.Errorf("Expected disallowed upload type, but got %v %q", w.Code, w.Body.String())
+	}
+}
+
+func TestUploadProgress(t *testing.T) {
+	codec := NewCodec(WithUploadProgress())
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "multipart/form-data")
+	s.RegisterService(new(Avatar), "")
+	ts := httptest.NewServer(codec.UploadProgressHandler())
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "?id=u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected an event stream, but got %q", ct)
+	}
+	events := bufio.NewReader(res.Body)
+	if line, _ := events.ReadString('\n'); line != ": subscribed\n" {
+		t.Fatalf("Expected the subscription comment, but got %q", line)
+	}
+
+	r := newUpload(strings.Repeat("x", 256<<10))
+	r.Header.Set("X-Upload-Id", "u1")
+	total := r.ContentLength
+	w := serve(s, r)
+	if env := uploadEnvelope(t, w.Body.String()); env["type"] != "rpc" {
+		t.Fatalf("Expected the upload to succeed, but got %v", env)
+	}
+
+	var progress []Progress
+	var name string
+	for {
+		line, err := events.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Expected a done event, but got %v after %v", err, progress)
+		}
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimSpace(line[len("event: "):])
+		case strings.HasPrefix(line, "data: "):
+			var p Progress
+			if err := json.Unmarshal([]byte(line[len("data: "):]), &p); err != nil {
+				t.Fatal(err)
+			}
+			if name == "done" {
+				if p.Read != total || p.Total != total {
+					t.Errorf("Expected the done event to report %d bytes, but got %+v", total, p)
+				}
+				if len(progress) < 2 {
+					t.Errorf("Expected several progress events, but got %v", progress)
+				}
+				return
+			}
+			if n := len(progress); n > 0 && p.Read <= progress[n-1].Read {
+				t.Errorf("Expected increasing progress, but got %+v after %+v", p, progress[n-1])
+			}
+			progress = append(progress, p)
+		}
+	}
+}
+
+func TestMaxFieldSize(t *testing.T) {
+	codec := NewCodec(WithMaxFieldSize(64))
+	rt := newRouter(codec, new(Avatar))
+	rt.server.RegisterCodec(codec, "multipart/form-data")
+
+	// Files are not limited.
+	w, _ := route(rt, newUpload(strings.Repeat("x", 1024)))
+	if env := uploadEnvelope(t, w.Body.String()); env["type"] != "rpc" {
+		t.Errorf("Expected the upload to succeed, but got %v", env)
+	}
+
+	newPost := func() *http.Request {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("extAction", "Avatar")
+		mw.WriteField("extMethod", "Upload")
+		mw.WriteField("extTID", "4")
+		mw.WriteField("extType", "rpc")
+		mw.WriteField("Title", strings.Repeat("t", 65))
+		mw.Close()
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		return r
+	}
+	w, env := route(rt, newPost())
+	if w.Code != http.StatusRequestEntityTooLarge || env["type"] != "exception" || env["message"] != ErrFieldTooLarge.Error() {
+		t.Errorf("Expected a field too large exception, but got %v %q", w.Code, w.Body.String())
+	}
+
+	// The codec enforces the limit without a router too.
+	w = serve(rt.server, newPost())
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), ErrFieldTooLarge.Error()) {
+		t.Errorf("Expected the codec to reject the field, but got %v %q", w.Code, w.Body.String())
+	}
+}
+
+func TestUploadLimit(t *testing.T) {
+	codec := NewCodec(WithUploadLimit(1))
+	rt := newRouter(codec, new(Avatar))
+	rt.server.RegisterCodec(codec, "multipart/form-data")
+
+	// Hold the only slot with an upload whose body is still being sent.
+	var body bytes.Buffer
+	full := newUpload("first")
+	body.ReadFrom(full.Body)
+	pr, pw := io.Pipe()
+	slow, _ := http.NewRequest("POST", "http://localhost:8080/", pr)
+	slow.Header.Set("Content-Type", full.Header.Get("Content-Type"))
+	first := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, slow)
+		first <- w
+	}()
+	b := body.Bytes()
+	pw.Write(b[:10])
+
+	w, _ := route(rt, newUpload("second"))
+	if env := uploadEnvelope(t, w.Body.String()); w.Code != http.StatusServiceUnavailable || env["type"] != "exception" || env["code"] != "busy" {
+		t.Errorf("Expected a busy exception, but got %v %q", w.Code, w.Body.String())
+	}
+
+	pw.Write(b[10:])
+	pw.Close()
+	if env := uploadEnvelope(t, (<-first).Body.String()); env["type"] != "rpc" {
+		t.Errorf("Expected the first upload to succeed, but got %v", env)
+	}
+	w, _ = route(rt, newUpload("third"))
+	if env := uploadEnvelope(t, w.Body.String()); env["type"] != "rpc" {
+		t.Errorf("Expected the slot to be released, but got %v", env)
+	}
+
+	// No limit is set for n <= 0.
+	codec = NewCodec(WithUploadLimit(0))
+	rt = newRouter(codec, new(Avatar))
+	rt.server.RegisterCodec(codec, "multipart/form-data")
+	w, _ = route(rt, newUpload("fourth"))
+	if env := uploadEnvelope(t, w.Body.String()); env["type"] != "rpc" {
+		t.Errorf("Expected no upload limit, but got %v", env)
+	}
+}
+
+type Contact struct{}
+
+func (c *Contact) Save(r *http.Request, req *map[string]interface{}, res *map[string]interface{}) error {
+	*res = *req
+	return nil
+}
+
+func TestFormFields(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/x-www-form-urlencoded")
+	s.RegisterService(new(Contact), "")
+
+	form := "extAction=Contact&extMethod=Save&extTID=3&extType=rpc&extension=42&external_id=a7&name=bob"
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(form))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var res map[string]interface{}
+	if err := DecodeClientResponse(serve(s, r).Body, &res); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"extension": "42", "external_id": "a7", "name": "bob"}
+	if len(res) != len(want) {
+		t.Errorf("Expected the data fields %v, but got %v", want, res)
+	}
+	for k, v := range want {
+		if res[k] != v {
+			t.Errorf("Expected field %s to be %v, but got %v", k, v, res[k])
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// acceptsGzip reports whether the client of r accepts gzip encoded
+// responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(strings.SplitN(enc, ";", 2)[0])
+		if strings.EqualFold(enc, "gzip") {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the body written to an http.ResponseWriter.
+// The header is only sent with the first write, so that responses without
+// a body, or whose status allows none, are passed through uncompressed.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	level int
+	gz    *gzip.Writer
+	// status is the status set by WriteHeader, sent once the body starts.
+	status      int
+	wroteHeader bool
+	started     bool
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+}
+
+// start sends the header of the response, compressing the body if compress
+// is set and the status allows a body.
+func (w *gzipResponseWriter) start(compress bool) {
+	if w.started {
+		return
+	}
+	w.started = true
+	w.WriteHeader(http.StatusOK)
+	if compress && bodyAllowed(w.status) {
+		h := w.Header()
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		// The level was validated by WithGzipLevel.
+		w.gz, _ = gzip.NewWriterLevel(w.ResponseWriter, w.level)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+// bodyAllowed reports whether a response with the given status may have a
+// body.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// Write implements http.ResponseWriter.
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	w.start(true)
+	if w.gz == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.gz.Write(p)
+}
+
+// Flush implements http.Flusher. Flushing before the body starts sends the
+// header uncompressed.
+func (w *gzipResponseWriter) Flush() {
+	w.start(false)
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close sends the header of responses without a body and completes the
+// compressed body.
+func (w *gzipResponseWriter) close() {
+	if w.wroteHeader {
+		w.start(false)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
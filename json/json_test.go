@@ -7,12 +7,22 @@ package json
 
 import (
 	"bytes"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/gorilla/rpc"
 )
@@ -45,6 +55,24 @@ func (t *Service1) ResponseError(r *http.Request, req *Service1Request, res *Ser
 	return ErrResponseError
 }
 
+func (t *Service1) StackError(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return NewStackError(r.Context(), ErrResponseError)
+}
+
+func (t *Service1) PartialError(r *http.Request, req *Service1Request, res *Service1Response) error {
+	res.Result = req.A * req.B
+	return ErrResponseError
+}
+
+func (t *Service1) Sleep(r *http.Request, req *Service1Request, res *Service1Response) error {
+	time.Sleep(time.Duration(req.A) * time.Millisecond)
+	return nil
+}
+
+func (t *Service1) Expired(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return NewReauthError("session expired")
+}
+
 func (t *Service1) BeforeAfter(r *http.Request, req *Service1Request, res *Service1Response) error {
 	if _, ok := t.beforeAfterContext["before"]; !ok {
 		return fmt.Errorf("before value not found in context")
@@ -80,6 +108,18 @@ func executeRaw(t *testing.T, s *rpc.Server, req interface{}, res interface{}) i
 	return w.Code
 }
 
+func newRequest(body string) *http.Request {
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBufferString(body))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+func serve(s *rpc.Server, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
 func TestService(t *testing.T) {
 	s := rpc.NewServer()
 	s.RegisterCodec(NewCodec(), "application/json")
@@ -131,3 +171,1597 @@ func TestServiceBeforeAfter(t *testing.T) {
 		t.Errorf("Expected after in context to be 'After is true', got %s", afterValue)
 	}
 }
+
+func TestStrictTid(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithStrictTid()), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	w := serve(s, newRequest(`{"action":"Service1","method":"Multiply","type":"rpc","tid":{"a":1},"data":[{"A":4,"B":2}]}`))
+	if w.Code != 400 {
+		t.Errorf("Expected http response code 400, but got %v", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "tid must be a number or a string") {
+		t.Errorf("Expected tid error, but got %q", w.Body.String())
+	}
+
+	var res Service1Response
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if res.Result != 8 {
+		t.Errorf("Wrong response: %v.", res.Result)
+	}
+}
+
+type GridRows struct {
+	Rows [][]string
+}
+
+func (g *GridRows) ExportCSV(w *csv.Writer) error {
+	if err := w.Write([]string{"name", "qty"}); err != nil {
+		return err
+	}
+	return w.WriteAll(g.Rows)
+}
+
+type Grid struct{}
+
+func (g *Grid) Export(r *http.Request, req *struct{}, res *GridRows) error {
+	res.Rows = [][]string{{"apple", "3"}, {"pear", "5"}}
+	return nil
+}
+
+func (g *Grid) Changes(r *http.Request, req *struct{}, res *PatchResult) error {
+	res.Replace("/rows/0/qty", 4).Add("/rows/-", []string{"plum", "1"}).Remove("/rows/1")
+	return nil
+}
+
+func TestPatchResult(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Grid), "")
+
+	w := serve(s, newRequest(`{"action":"Grid","method":"Changes","type":"rpc","tid":1,"data":null}`))
+	var env struct {
+		Result struct {
+			Patch bool
+			Ops   []map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+		t.Fatal(err)
+	}
+	if !env.Result.Patch || len(env.Result.Ops) != 3 {
+		t.Fatalf("Expected a marked patch of 3 operations, but got %q", w.Body.String())
+	}
+	if op := env.Result.Ops[0]; op["op"] != "replace" || op["path"] != "/rows/0/qty" || op["value"] != float64(4) {
+		t.Errorf("Expected replace operation, but got %v", op)
+	}
+	if op := env.Result.Ops[1]; op["op"] != "add" || op["path"] != "/rows/-" || op["value"] == nil {
+		t.Errorf("Expected add operation, but got %v", op)
+	}
+	if op := env.Result.Ops[2]; len(op) != 2 || op["op"] != "remove" || op["path"] != "/rows/1" {
+		t.Errorf("Expected remove operation without value, but got %v", op)
+	}
+}
+
+type Jobs struct{}
+
+func (j *Jobs) Cancel(r *http.Request, req *struct{}, res *map[string]interface{}) error {
+	return nil
+}
+
+func (j *Jobs) Purge(r *http.Request, req *[]int, res *MutationResult) error {
+	for _, id := range *req {
+		res.IDs = append(res.IDs, id)
+	}
+	res.Affected = len(res.IDs)
+	return nil
+}
+
+func TestMutationResult(t *testing.T) {
+	reg := NewRegistry()
+	reg.Add("Jobs", "Purge").SliceArg = true
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithRegistry(reg)), "application/json")
+	s.RegisterService(new(Jobs), "")
+
+	for data, want := range map[string]string{
+		`[41,42]`: `"result":{"affected":2,"ids":[41,42]}`,
+		`[]`:      `"result":{"affected":0,"ids":[]}`,
+	} {
+		w := serve(s, newRequest(`{"action":"Jobs","method":"Purge","type":"rpc","tid":1,"data":`+data+`}`))
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected %s, but got %q", want, w.Body.String())
+		}
+	}
+}
+
+func (j *Jobs) Retry(r *http.Request, req *[]int, res *BulkResult) error {
+	for _, id := range *req {
+		if id%2 == 0 {
+			res.Fail(id, &codedError{message: "job is running", code: "conflict"})
+		} else {
+			res.Succeed(id, nil)
+		}
+	}
+	return nil
+}
+
+func TestBulkResult(t *testing.T) {
+	reg := NewRegistry()
+	reg.Add("Jobs", "Retry").SliceArg = true
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithRegistry(reg)), "application/json")
+	s.RegisterService(new(Jobs), "")
+
+	for data, want := range map[string]string{
+		`[41,42]`: `"result":{"failed":[{"code":"conflict","id":42,"message":"job is running"}],"succeeded":[{"id":41}]}`,
+		`[]`:      `"result":{"failed":[],"succeeded":[]}`,
+	} {
+		w := serve(s, newRequest(`{"action":"Jobs","method":"Retry","type":"rpc","tid":1,"data":`+data+`}`))
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected %s, but got %q", want, w.Body.String())
+		}
+	}
+}
+
+func TestEmptyResult(t *testing.T) {
+	reg := NewRegistry()
+	reg.Add("Jobs", "Cancel").EmptyResult = true
+	for _, c := range []*Codec{NewCodec(), NewCodec(WithRegistry(reg))} {
+		s := rpc.NewServer()
+		s.RegisterCodec(c, "application/json")
+		s.RegisterService(new(Jobs), "")
+
+		w := serve(s, newRequest(`{"action":"Jobs","method":"Cancel","type":"rpc","tid":1,"data":null}`))
+		want := `"result":null`
+		if c.registry != nil {
+			want = `"result":{}`
+		}
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected %s, but got %q", want, w.Body.String())
+		}
+	}
+}
+
+type Session struct{}
+
+func (s *Session) Logout(r *http.Request, req *struct{}, res *Redirect) error {
+	res.URL = "/login"
+	return nil
+}
+
+func TestRedirectResult(t *testing.T) {
+	for _, header := range []bool{false, true} {
+		var opts []Option
+		if header {
+			opts = append(opts, WithRedirectHeader())
+		}
+		s := rpc.NewServer()
+		s.RegisterCodec(NewCodec(opts...), "application/json")
+		s.RegisterService(new(Session), "")
+
+		w := serve(s, newRequest(`{"action":"Session","method":"Logout","type":"rpc","tid":1,"data":null}`))
+		var env struct {
+			Result map[string]string
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+			t.Fatal(err)
+		}
+		if len(env.Result) != 1 || env.Result["redirect"] != "/login" {
+			t.Errorf("Expected redirect result, but got %q", w.Body.String())
+		}
+		want := ""
+		if header {
+			want = "/login"
+		}
+		if got := w.Header().Get("X-RPC-Redirect"); got != want {
+			t.Errorf("Expected X-RPC-Redirect %q, but got %q", want, got)
+		}
+	}
+}
+
+func TestCSVExport(t *testing.T) {
+	reg := NewRegistry()
+	reg.Add("Grid", "Export").CSV = true
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithRegistry(reg)), "application/json")
+	s.RegisterService(new(Grid), "")
+
+	body := `{"action":"Grid","method":"Export","type":"rpc","tid":1,"data":null}`
+	r := newRequest(body)
+	r.Header.Set("X-RPC-Format", "csv")
+	w := serve(s, r)
+	if ct := w.Header().Get("Content-Type"); ct != "text/csv; charset=utf-8" {
+		t.Errorf("Expected text/csv content type, but got %q", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename="Export.csv"` {
+		t.Errorf("Expected attachment disposition, but got %q", cd)
+	}
+	if got, want := w.Body.String(), "name,qty\napple,3\npear,5\n"; got != want {
+		t.Errorf("Expected CSV %q, but got %q", want, got)
+	}
+
+	// Without the header the reply is encoded as JSON.
+	w = serve(s, newRequest(body))
+	if !strings.Contains(w.Body.String(), `"result":{"Rows":`) {
+		t.Errorf("Expected JSON result, but got %q", w.Body.String())
+	}
+}
+
+func TestReplyAndError(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	res := Service1Response{Result: -1}
+	if err := execute(t, s, "Service1.PartialError", &Service1Request{4, 2}, &res); err == nil {
+		t.Errorf("Expected to get %q, but got nil", ErrResponseError)
+	} else if err.Error() != ErrResponseError.Error() {
+		t.Errorf("Expected to get %q, but got %q", ErrResponseError, err)
+	}
+	if res.Result != -1 {
+		t.Errorf("Expected reply to be discarded, but got %v", res.Result)
+	}
+
+	w := serve(s, newRequest(`{"action":"Service1","method":"PartialError","type":"rpc","tid":7,"data":[{"A":4,"B":2}]}`))
+	var env map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+		t.Fatal(err)
+	}
+	if env["type"] != "exception" || env["message"] != ErrResponseError.Error() {
+		t.Errorf("Expected exception envelope, but got %v", env)
+	}
+	if _, ok := env["result"]; ok {
+		t.Errorf("Expected no result in exception envelope, but got %v", env["result"])
+	}
+}
+
+func TestPartialReply(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithPartialReply()), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	w := serve(s, newRequest(`{"action":"Service1","method":"PartialError","type":"rpc","tid":7,"data":[{"A":4,"B":2}]}`))
+	var env map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+		t.Fatal(err)
+	}
+	if env["type"] != "exception" || env["message"] != ErrResponseError.Error() {
+		t.Errorf("Expected exception envelope, but got %v", env)
+	}
+	if data, ok := env["data"].(map[string]interface{}); !ok || data["Result"] != float64(8) {
+		t.Errorf("Expected partial reply under data, but got %v", env["data"])
+	}
+
+	w = serve(s, newRequest(`{"action":"Service1","method":"ResponseError","type":"rpc","tid":8,"data":[{"A":4,"B":2}]}`))
+	env = nil
+	json.Unmarshal(w.Body.Bytes(), &env)
+	if _, ok := env["data"]; ok {
+		t.Errorf("Expected no data for an empty reply, but got %v", env["data"])
+	}
+}
+
+func TestResponseRewrite(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithResponseRewrite("X-Client-Version", func(version string, fields map[string]interface{}) {
+		if strings.HasPrefix(version, "2.") {
+			fields["id"] = fields["tid"]
+			delete(fields, "tid")
+			fields["success"] = fields["type"] != "exception"
+		}
+	})), "application/json")
+	s.RegisterService(new(Service1), "")
+	body := `{"action":"Service1","method":"Multiply","type":"rpc","tid":7,"data":[{"A":4,"B":2}]}`
+
+	r := newRequest(body)
+	r.Header.Set("X-Client-Version", "2.3")
+	var env map[string]interface{}
+	json.Unmarshal(serve(s, r).Body.Bytes(), &env)
+	if _, ok := env["tid"]; ok || env["id"] != float64(7) || env["success"] != true {
+		t.Errorf("Expected legacy envelope, but got %v", env)
+	}
+
+	for _, version := range []string{"", "6.2"} {
+		r := newRequest(body)
+		if version != "" {
+			r.Header.Set("X-Client-Version", version)
+		}
+		env = nil
+		json.Unmarshal(serve(s, r).Body.Bytes(), &env)
+		if _, ok := env["id"]; ok || env["tid"] != float64(7) {
+			t.Errorf("Expected standard envelope for version %q, but got %v", version, env)
+		}
+	}
+
+	// Large integers are not rounded.
+	s.RegisterService(new(Numbers), "")
+	r = newRequest(`{"action":"Numbers","method":"Sum","type":"rpc","tid":8,"data":[[9007199254740993]]}`)
+	r.Header.Set("X-Client-Version", "2.3")
+	if w := serve(s, r); !strings.Contains(w.Body.String(), `"result":9007199254740993`) {
+		t.Errorf("Expected the exact result, but got %q", w.Body.String())
+	}
+}
+
+func TestEncoderSelection(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithEncoder("pretty", PrettyEncoder)), "application/json")
+	s.RegisterService(new(Service1), "")
+	body := `{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":[{"A":4,"B":2}]}`
+
+	r := newRequest(body)
+	r.Header.Set("X-RPC-Accept", "pretty")
+	w := serve(s, r)
+	if !strings.Contains(w.Body.String(), "\n  \"result\": {\n    \"Result\": 8\n  },") {
+		t.Errorf("Expected pretty output, but got %q", w.Body.String())
+	}
+
+	for _, accept := range []string{"", "yaml"} {
+		r := newRequest(body)
+		r.Header.Set("X-RPC-Accept", accept)
+		w := serve(s, r)
+		if !strings.Contains(w.Body.String(), `"result":{"Result":8}`) {
+			t.Errorf("Expected compact output for %q, but got %q", accept, w.Body.String())
+		}
+	}
+}
+
+func TestOmitEmpty(t *testing.T) {
+	for _, omit := range []bool{false, true} {
+		opts := []Option{WithEnvelopeFinalizer(func(env *Envelope) {
+			env.Extra = map[string]interface{}{
+				"metaData": map[string]interface{}{},
+				"where":    nil,
+				"note":     "",
+				"total":    0,
+				"success":  true,
+			}
+		})}
+		if omit {
+			opts = append(opts, WithOmitEmpty())
+		}
+		s := rpc.NewServer()
+		s.RegisterCodec(NewCodec(opts...), "application/json")
+		s.RegisterService(new(Jobs), "")
+
+		w := serve(s, newRequest(`{"action":"Jobs","method":"Cancel","type":"rpc","tid":1,"data":null}`))
+		var env map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"metaData", "where", "note"} {
+			if _, ok := env[k]; ok == omit {
+				t.Errorf("Omit %v: unexpected presence of %q in %q", omit, k, w.Body.String())
+			}
+		}
+		for _, k := range []string{"type", "tid", "action", "method", "result", "total", "success"} {
+			if _, ok := env[k]; !ok {
+				t.Errorf("Omit %v: expected %q in %q", omit, k, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestEnvelopeFinalizer(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithEnvelopeFinalizer(func(env *Envelope) {
+		env.Extra = map[string]interface{}{"correlationId": "abc-" + env.Method}
+	})), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	for _, method := range []string{"Multiply", "ResponseError"} {
+		w := serve(s, newRequest(`{"action":"Service1","method":"`+method+`","type":"rpc","tid":1,"data":[{"A":4,"B":2}]}`))
+		var env map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+			t.Fatal(err)
+		}
+		if env["correlationId"] != "abc-"+method {
+			t.Errorf("%s: Expected injected correlationId, but got %v", method, env)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	codec := NewCodec()
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res)
+	execute(t, s, "Service1.ResponseError", &Service1Request{4, 2}, &res)
+	execute(t, s, "Service1.Sleep", &Service1Request{A: 30}, &res)
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/metrics", nil)
+	w := httptest.NewRecorder()
+	codec.MetricsHandler().ServeHTTP(w, r)
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Expected Prometheus text format, but got %q", ct)
+	}
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE rpc_requests_total counter\nrpc_requests_total 3\n",
+		"# TYPE rpc_errors_total counter\nrpc_errors_total 1\n",
+		"rpc_sla_violations_total 0\n",
+		"# TYPE rpc_request_duration_seconds histogram\n",
+		"rpc_request_duration_seconds_bucket{le=\"0.025\"} 2\n",
+		"rpc_request_duration_seconds_bucket{le=\"+Inf\"} 3\n",
+		"rpc_request_duration_seconds_count 3\n",
+		"rpc_request_duration_seconds_sum ",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Expected %q in the metrics, but got:\n%s", line, body)
+		}
+	}
+}
+
+func TestMethodSLA(t *testing.T) {
+	reg := NewRegistry()
+	reg.Add("Service1", "Sleep").SLA = time.Millisecond
+	var buf bytes.Buffer
+	codec := NewCodec(WithRegistry(reg), WithLogger(log.New(&buf, "", 0)))
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	if err := execute(t, s, "Service1.Sleep", &Service1Request{A: 20}, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if !strings.Contains(buf.String(), "Service1.Sleep took") {
+		t.Errorf("Expected SLA warning, but got %q", buf.String())
+	}
+	if n := codec.Stats().SLAViolations; n != 1 {
+		t.Errorf("Expected 1 SLA violation, but got %d", n)
+	}
+
+	buf.Reset()
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected no warning, but got %q", buf.String())
+	}
+}
+
+type Files struct {
+	closed int
+}
+
+func (f *Files) Get(r *http.Request, req *struct{ Name string }, res *DownloadResult) error {
+	res.Name = req.Name
+	res.ContentType = "text/plain"
+	res.Reader = strings.NewReader("file contents")
+	switch req.Name {
+	case "denied.txt":
+		res.Reader = &fileReader{Reader: res.Reader, files: f}
+		return errors.New("denied")
+	case "broken.txt":
+		res.Reader = &fileReader{Reader: iotest.TimeoutReader(res.Reader), files: f}
+	}
+	return nil
+}
+
+// fileReader counts its Close calls in files.
+type fileReader struct {
+	io.Reader
+	files *Files
+}
+
+func (r *fileReader) Close() error {
+	r.files.closed++
+	return nil
+}
+
+func TestDownloadResult(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Files), "")
+
+	tests := []struct {
+		name        string
+		disposition string
+	}{
+		{"report.txt", `attachment; filename="report.txt"`},
+		{`say "hi".txt`, `attachment; filename="say \"hi\".txt"`},
+		{"résumé.txt", `attachment; filename="r_sum_.txt"; filename*=UTF-8''r%C3%A9sum%C3%A9.txt`},
+	}
+	for _, test := range tests {
+		buf, _ := EncodeClientRequest("Files.Get", &struct{ Name string }{test.name})
+		w := serve(s, newRequest(string(buf)))
+		if cd := w.Header().Get("Content-Disposition"); cd != test.disposition {
+			t.Errorf("Expected disposition %q, but got %q", test.disposition, cd)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "text/plain" {
+			t.Errorf("Expected text/plain content type, but got %q", ct)
+		}
+		if body := w.Body.String(); body != "file contents" {
+			t.Errorf("Expected streamed file, but got %q", body)
+		}
+	}
+
+	files := new(Files)
+	s = rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithLogger(log.New(ioutil.Discard, "", 0))), "application/json")
+	s.RegisterService(files, "")
+	buf, _ := EncodeClientRequest("Files.Get", &struct{ Name string }{"denied.txt"})
+	if w := serve(s, newRequest(string(buf))); w.Header().Get("Content-Disposition") != "" {
+		t.Errorf("Expected no attachment for a failed call, but got %v", w.Header())
+	}
+	buf, _ = EncodeClientRequest("Files.Get", &struct{ Name string }{"broken.txt"})
+	w := serve(s, newRequest(string(buf)))
+	if w.Code != 200 || w.Body.String() != "file contents" {
+		t.Errorf("Expected the written part of the file only, but got %v %q", w.Code, w.Body.String())
+	}
+	if files.closed != 2 {
+		t.Errorf("Expected the readers to be closed, but %d were", files.closed)
+	}
+}
+
+func TestEmptyDataArray(t *testing.T) {
+	body := `{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":[]}`
+
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	if w := serve(s, newRequest(body)); w.Code != 400 {
+		t.Errorf("Expected http response code 400, but got %v", w.Code)
+	}
+
+	s = rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithZeroFillMissingArgs()), "application/json")
+	s.RegisterService(new(Service1), "")
+	var res Service1Response
+	if err := DecodeClientResponse(serve(s, newRequest(body)).Body, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if res.Result != 0 {
+		t.Errorf("Expected zero-filled arguments, but got result %v", res.Result)
+	}
+}
+
+func TestTokenAuthWithoutRouter(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithTokenAuth(func(token string) (Principal, error) {
+		return "bob", nil
+	})), "application/json")
+	s.RegisterService(new(WhoAmI), "")
+
+	body := `{"action":"WhoAmI","method":"Get","type":"rpc","tid":1,"data":null}`
+	if w := serve(s, newRequest(body)); w.Code != 400 {
+		t.Errorf("Expected http response code 400 without token, but got %v", w.Code)
+	}
+	r := newRequest(body)
+	r.Header.Set("Authorization", "bearer any")
+	var res string
+	if err := DecodeClientResponse(serve(s, r).Body, &res); err != nil || res != "bob" {
+		t.Errorf("Expected principal bob, but got %q, %v", res, err)
+	}
+}
+
+func TestReauthError(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	w := serve(s, newRequest(`{"action":"Service1","method":"Expired","type":"rpc","tid":2,"data":[{}]}`))
+	var env map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+		t.Fatal(err)
+	}
+	if env["type"] != "exception" || env["code"] != "reauth" || env["message"] != "session expired" {
+		t.Errorf("Expected reauth exception, but got %v", env)
+	}
+}
+
+func TestDebugTiming(t *testing.T) {
+	body := `{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":[{"A":4,"B":2}]}`
+	for _, debug := range []bool{false, true} {
+		var opts []Option
+		if debug {
+			opts = append(opts, WithDebug())
+		}
+		s := rpc.NewServer()
+		s.RegisterCodec(NewCodec(opts...), "application/json")
+		s.RegisterService(new(Service1), "")
+
+		var env struct {
+			Result Service1Response
+			Meta   *struct {
+				Timing map[string]float64
+			}
+		}
+		if err := json.Unmarshal(serve(s, newRequest(body)).Body.Bytes(), &env); err != nil {
+			t.Fatal(err)
+		}
+		if env.Result.Result != 8 {
+			t.Errorf("Wrong response: %v.", env.Result.Result)
+		}
+		if !debug {
+			if env.Meta != nil {
+				t.Errorf("Expected no meta outside debug mode, but got %v", env.Meta)
+			}
+			continue
+		}
+		if env.Meta == nil {
+			t.Fatal("Expected meta in debug mode")
+		}
+		for _, key := range []string{"decode", "dispatch", "encode"} {
+			if _, ok := env.Meta.Timing[key]; !ok {
+				t.Errorf("Expected timing key %q, but got %v", key, env.Meta.Timing)
+			}
+		}
+	}
+}
+
+func TestEchoParams(t *testing.T) {
+	body := `{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":[{"A":4,"B":2}]}`
+	for _, debug := range []bool{false, true} {
+		opts := []Option{WithEchoParams()}
+		if debug {
+			opts = append(opts, WithDebug())
+		}
+		s := rpc.NewServer()
+		s.RegisterCodec(NewCodec(opts...), "application/json")
+		s.RegisterService(new(Service1), "")
+
+		var env struct {
+			Meta struct {
+				Params []map[string]int
+			}
+		}
+		w := serve(s, newRequest(body))
+		if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+			t.Fatal(err)
+		}
+		if !debug {
+			if env.Meta.Params != nil {
+				t.Errorf("Expected no params outside debug mode, but got %q", w.Body.String())
+			}
+			continue
+		}
+		if p := env.Meta.Params; len(p) != 1 || p[0]["A"] != 4 || p[0]["B"] != 2 {
+			t.Errorf("Expected echoed params, but got %q", w.Body.String())
+		}
+	}
+}
+
+func TestStackCapture(t *testing.T) {
+	body := `{"action":"Service1","method":"StackError","type":"rpc","tid":1,"data":[{"A":4,"B":2}]}`
+	for _, capture := range []bool{true, false} {
+		s := rpc.NewServer()
+		s.RegisterCodec(NewCodec(WithDebug(), WithStackCapture(capture)), "application/json")
+		s.RegisterService(new(Service1), "")
+
+		var env map[string]interface{}
+		if err := json.Unmarshal(serve(s, newRequest(body)).Body.Bytes(), &env); err != nil {
+			t.Fatal(err)
+		}
+		where, ok := env["where"].(string)
+		if capture && (!ok || !strings.Contains(where, "(*Service1).StackError") || strings.Contains(where, "WriteResponse")) {
+			t.Errorf("Expected the stack of the method under where, but got %v", env["where"])
+		}
+		if !capture && ok {
+			t.Errorf("Expected no where with stack capture disabled, but got %q", where)
+		}
+		if _, ok := env["meta"]; !ok {
+			t.Errorf("Expected meta in debug mode, but got %v", env)
+		}
+	}
+
+	// Stacks are only recorded for calls capturing them.
+	if st := NewStackError(newRequest("").Context(), ErrResponseError).Stack(); st != "" {
+		t.Errorf("Expected no stack outside a call, but got %q", st)
+	}
+
+	// Errors without a stack have no where.
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithDebug()), "application/json")
+	s.RegisterService(new(Service1), "")
+	w := serve(s, newRequest(`{"action":"Service1","method":"ResponseError","type":"rpc","tid":1,"data":[{"A":4,"B":2}]}`))
+	if strings.Contains(w.Body.String(), `"where"`) {
+		t.Errorf("Expected no where for an error without stack, but got %q", w.Body.String())
+	}
+}
+
+func BenchmarkStackCapture(b *testing.B) {
+	for _, capture := range []bool{true, false} {
+		b.Run(fmt.Sprintf("capture=%v", capture), func(b *testing.B) {
+			r := newRequest("")
+			withCallState(r).captureStack = capture
+			ctx := r.Context()
+			for i := 0; i < b.N; i++ {
+				NewStackError(ctx, ErrResponseError)
+			}
+		})
+	}
+}
+
+func TestQualifiedMethods(t *testing.T) {
+	body := `{"action":"","method":"Service1.Multiply","type":"rpc","tid":1,"data":[{"A":4,"B":2}]}`
+	for _, qualified := range []bool{false, true} {
+		var opts []Option
+		if qualified {
+			opts = append(opts, WithQualifiedMethods())
+		}
+		s := rpc.NewServer()
+		s.RegisterCodec(NewCodec(opts...), "application/json")
+		s.RegisterService(new(Service1), "")
+
+		w := serve(s, newRequest(body))
+		if !qualified {
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected a fully-qualified method to be rejected by default, but got %v %q", w.Code, w.Body.String())
+			}
+			continue
+		}
+		var env struct {
+			Action, Method string
+			Result         Service1Response
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+			t.Fatal(err)
+		}
+		if env.Result.Result != 8 || env.Action != "Service1" || env.Method != "Multiply" {
+			t.Errorf("Expected Service1.Multiply to be called, but got %q", w.Body.String())
+		}
+	}
+}
+
+type Legacy struct{}
+
+func (l *Legacy) Ping(args *int, reply *int) error {
+	return nil
+}
+
+func TestRegistryRegisterService(t *testing.T) {
+	reg := NewRegistry()
+	reg.Add("Service1", "Multiply")
+	reg.Add("Jobs", "Cancel").Len = 0
+	s := rpc.NewServer()
+	if err := reg.RegisterService(s, new(Service1), ""); err != nil {
+		t.Errorf("Expected Service1 to register, but got %v", err)
+	}
+	if err := reg.RegisterService(s, new(Jobs), ""); err != nil {
+		t.Errorf("Expected Jobs to register, but got %v", err)
+	}
+
+	reg.Add("Service1", "Multiply").Len = 2
+	err := reg.RegisterService(rpc.NewServer(), new(Service1), "")
+	if err == nil || !strings.Contains(err.Error(), "Service1.Multiply declares len 2 but takes 1 argument") {
+		t.Errorf("Expected a len mismatch error, but got %v", err)
+	}
+
+	reg = NewRegistry()
+	reg.Add("Service1", "Missing")
+	s = rpc.NewServer()
+	if err := reg.RegisterService(s, new(Service1), ""); err == nil {
+		t.Error("Expected an error for a method missing from the service")
+	}
+	if s.HasMethod("Service1.Multiply") {
+		t.Error("Expected the service not to be registered on error")
+	}
+
+	reg = NewRegistry()
+	reg.Add("Legacy", "Ping")
+	err = reg.RegisterService(rpc.NewServer(), new(Legacy), "")
+	if err == nil || !strings.Contains(err.Error(), "Legacy.Ping is in the registry but has signature func(*int, *int) error") {
+		t.Errorf("Expected a signature mismatch error, but got %v", err)
+	}
+
+	reg = NewRegistry()
+	reg.Add("Numbers", "Sum").SliceArg = true
+	if err := reg.RegisterService(rpc.NewServer(), new(Numbers), ""); err != nil {
+		t.Errorf("Expected SliceArg method to register, but got %v", err)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	reg := NewRegistry()
+	reg.Add("Service1", "Multiply")
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithRegistry(reg), WithCaseInsensitive()), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	w := serve(s, newRequest(`{"action":"service1","method":"MULTIPLY","type":"rpc","tid":1,"data":[{"A":4,"B":2}]}`))
+	if err := DecodeClientResponse(w.Body, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if res.Result != 8 {
+		t.Errorf("Wrong response: %v.", res.Result)
+	}
+}
+
+type Numbers struct{}
+
+func (n *Numbers) Sum(r *http.Request, req *[]int, res *int) error {
+	for _, v := range *req {
+		*res += v
+	}
+	return nil
+}
+
+func TestSliceArg(t *testing.T) {
+	body := `{"action":"Numbers","method":"Sum","type":"rpc","tid":1,"data":[1,2,3]}`
+	reg := NewRegistry()
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithRegistry(reg)), "application/json")
+	s.RegisterService(new(Numbers), "")
+
+	// As positional arguments the first element does not fit []int.
+	if w := serve(s, newRequest(body)); w.Code != 400 {
+		t.Errorf("Expected http response code 400, but got %v", w.Code)
+	}
+
+	reg.Add("Numbers", "Sum").SliceArg = true
+	var res int
+	if err := DecodeClientResponse(serve(s, newRequest(body)).Body, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if res != 6 {
+		t.Errorf("Expected sum 6, but got %v", res)
+	}
+}
+
+func TestResponseStatus(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithNotificationStatus(202), WithResponseStatus(203)), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	w := serve(s, newRequest(`{"action":"Service1","method":"Multiply","type":"rpc","data":[{"A":4,"B":2}]}`))
+	if w.Code != 202 || w.Body.Len() != 0 {
+		t.Errorf("Expected empty 202 for notification, but got %v %q", w.Code, w.Body.String())
+	}
+	w = serve(s, newRequest(`{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":[{"A":4,"B":2}]}`))
+	if w.Code != 203 {
+		t.Errorf("Expected 203 for normal response, but got %v", w.Code)
+	}
+
+	s = rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	if w = serve(s, newRequest(`{"action":"Service1","method":"Multiply","type":"rpc","data":[{"A":4,"B":2}]}`)); w.Code != 200 {
+		t.Errorf("Expected default 200 for notification, but got %v", w.Code)
+	}
+}
+
+type Profile struct{}
+
+func (p *Profile) Submit(r *http.Request, req *map[string]string, res *FormResult) error {
+	res.Success = true
+	res.Data = map[string]string{"id": "42"}
+	if len((*req)["phone"]) < 6 {
+		res.Warnings = map[string]string{"phone": "looks too short"}
+	}
+	return nil
+}
+
+func TestFormWarnings(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Profile), "")
+
+	w := serve(s, newRequest(`{"action":"Profile","method":"Submit","type":"rpc","tid":1,"data":[{"phone":"123"}]}`))
+	var env struct {
+		Result map[string]interface{}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.Result["success"] != true {
+		t.Errorf("Expected success true, but got %v", env.Result)
+	}
+	warnings, _ := env.Result["warnings"].(map[string]interface{})
+	if warnings["phone"] != "looks too short" {
+		t.Errorf("Expected phone warning, but got %v", env.Result)
+	}
+	if _, ok := env.Result["errors"]; ok {
+		t.Errorf("Expected no errors, but got %v", env.Result["errors"])
+	}
+}
+
+// shortReader returns its data and then io.EOF, however many bytes the
+// request declared.
+type shortReader struct {
+	*strings.Reader
+}
+
+func (shortReader) Close() error { return nil }
+
+func TestStrictContentLength(t *testing.T) {
+	body := `{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":[{"A":4,"B":2}]}`
+	truncated := func() *http.Request {
+		r := newRequest("")
+		r.Body = shortReader{strings.NewReader(body)}
+		r.ContentLength = int64(len(body) + 100)
+		return r
+	}
+
+	codec := NewCodec(WithStrictContentLength())
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/json")
+	s.RegisterService(new(Service1), "")
+	w := serve(s, truncated())
+	if w.Code != 400 || !strings.Contains(w.Body.String(), ErrContentLength.Error()) {
+		t.Errorf("Expected content length error, but got %v %q", w.Code, w.Body.String())
+	}
+	if w = serve(s, newRequest(body)); w.Code != 200 {
+		t.Errorf("Expected matching body to be served, but got %v %q", w.Code, w.Body.String())
+	}
+
+	rt := NewRouter(s, codec)
+	w, env := route(rt, truncated())
+	if w.Code != 400 || env["message"] != ErrContentLength.Error() || env["tid"] != 1.0 {
+		t.Errorf("Expected content length exception, but got %v %q", w.Code, w.Body.String())
+	}
+}
+
+type Measures struct{}
+
+func (m *Measures) Get(r *http.Request, req *struct{}, res *map[string]interface{}) error {
+	*res = map[string]interface{}{"big": 1e21, "small": 0.0000001, "pi": 3.14159, "n": 8, "s": "1.5e3"}
+	return nil
+}
+
+func TestFloatFormat(t *testing.T) {
+	body := `{"action":"Measures","method":"Get","type":"rpc","tid":1,"data":null}`
+	tests := []struct {
+		opts []Option
+		want string
+	}{
+		{nil, `{"big":1e+21,"n":8,"pi":3.14159,"s":"1.5e3","small":1e-7}`},
+		{[]Option{WithFloatFormat(-1)}, `{"big":1000000000000000000000,"n":8,"pi":3.14159,"s":"1.5e3","small":0.0000001}`},
+		{[]Option{WithFloatFormat(2)}, `{"big":1000000000000000000000.00,"n":8,"pi":3.14,"s":"1.5e3","small":0.00}`},
+	}
+	for _, test := range tests {
+		s := rpc.NewServer()
+		s.RegisterCodec(NewCodec(test.opts...), "application/json")
+		s.RegisterService(new(Measures), "")
+		var env struct {
+			Result json.RawMessage
+		}
+		if err := json.Unmarshal(serve(s, newRequest(body)).Body.Bytes(), &env); err != nil {
+			t.Fatal(err)
+		}
+		if string(env.Result) != test.want {
+			t.Errorf("Expected result %s, but got %s", test.want, env.Result)
+		}
+	}
+}
+
+func TestErrorReference(t *testing.T) {
+	var buf bytes.Buffer
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithErrorReference(), WithLogger(log.New(&buf, "", 0))), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	w := serve(s, newRequest(`{"action":"Service1","method":"ResponseError","type":"rpc","tid":1,"data":[{}]}`))
+	var env struct {
+		Message string
+		Meta    struct {
+			Ref string
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+		t.Fatal(err)
+	}
+	if len(env.Meta.Ref) != 8 {
+		t.Fatalf("Expected an 8 character reference, but got %q", env.Meta.Ref)
+	}
+	if want := ErrResponseError.Error() + " (ref " + env.Meta.Ref + ")"; env.Message != want {
+		t.Errorf("Expected message %q, but got %q", want, env.Message)
+	}
+	if want := "rpc: error ref " + env.Meta.Ref + " in Service1.ResponseError: response error\n"; buf.String() != want {
+		t.Errorf("Expected log %q, but got %q", want, buf.String())
+	}
+}
+
+type Echo struct{}
+
+func (e *Echo) Say(r *http.Request, req *string, res *string) error {
+	*res = *req
+	return nil
+}
+
+func TestUnwrapStringData(t *testing.T) {
+	body := `{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":"[{\"A\":4,\"B\":2}]"}`
+
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	if w := serve(s, newRequest(body)); w.Code != 400 {
+		t.Errorf("Expected http response code 400, but got %v", w.Code)
+	}
+
+	s = rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithUnwrapStringData()), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.RegisterService(new(Echo), "")
+	var res Service1Response
+	if err := DecodeClientResponse(serve(s, newRequest(body)).Body, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if res.Result != 8 {
+		t.Errorf("Wrong response: %v.", res.Result)
+	}
+
+	// A string argument holding JSON is passed through as is.
+	var said string
+	w := serve(s, newRequest(`{"action":"Echo","method":"Say","type":"rpc","tid":2,"data":["[1,2]"]}`))
+	if err := DecodeClientResponse(w.Body, &said); err != nil || said != "[1,2]" {
+		t.Errorf("Expected string argument to be kept, but got %q, %v", said, err)
+	}
+}
+
+var catalogModified = time.Date(2016, 10, 3, 12, 0, 0, 0, time.UTC)
+
+type Catalog struct{}
+
+func (c *Catalog) Read(r *http.Request, req *struct{}, res *[]string) error {
+	SetLastModified(r.Context(), catalogModified)
+	*res = []string{"apple", "pear"}
+	return nil
+}
+
+func (c *Catalog) Save(r *http.Request, req *[]string, res *int) error {
+	SetLastModified(r.Context(), catalogModified)
+	*res = len(*req)
+	return nil
+}
+
+func TestLastModified(t *testing.T) {
+	reg := NewRegistry()
+	reg.Add("Catalog", "Read").Read = true
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithRegistry(reg)), "application/json")
+	s.RegisterService(new(Catalog), "")
+	body := `{"action":"Catalog","method":"Read","type":"rpc","tid":1,"data":null}`
+
+	w := serve(s, newRequest(body))
+	if w.Code != 200 || w.Header().Get("Last-Modified") != "Mon, 03 Oct 2016 12:00:00 GMT" {
+		t.Errorf("Expected 200 with Last-Modified, but got %v %v", w.Code, w.Header())
+	}
+	if !strings.Contains(w.Body.String(), `"result":["apple","pear"]`) {
+		t.Errorf("Expected result, but got %q", w.Body.String())
+	}
+
+	r := newRequest(body)
+	r.Header.Set("If-Modified-Since", "Mon, 03 Oct 2016 12:00:00 GMT")
+	if w = serve(s, r); w.Code != 304 || w.Body.Len() != 0 {
+		t.Errorf("Expected empty 304, but got %v %q", w.Code, w.Body.String())
+	}
+
+	r = newRequest(body)
+	r.Header.Set("If-Modified-Since", "Sun, 02 Oct 2016 12:00:00 GMT")
+	if w = serve(s, r); w.Code != 200 {
+		t.Errorf("Expected 200 for older copy, but got %v", w.Code)
+	}
+}
+
+func TestEnvelopeWrapper(t *testing.T) {
+	var order []string
+	var seen *Call
+	var seenEnv Envelope
+	audit := func(next EnvelopeFunc) EnvelopeFunc {
+		return func(call *Call) *Envelope {
+			order = append(order, "audit")
+			seen = call
+			env := next(call)
+			seenEnv = *env
+			return env
+		}
+	}
+	sign := func(next EnvelopeFunc) EnvelopeFunc {
+		return func(call *Call) *Envelope {
+			order = append(order, "sign")
+			env := next(call)
+			env.Extra = map[string]interface{}{"sig": "abc"}
+			return env
+		}
+	}
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithEnvelopeWrapper(audit), WithEnvelopeWrapper(sign)), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	w := serve(s, newRequest(`{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":[{"A":4,"B":2}]}`))
+	if strings.Join(order, ",") != "audit,sign" {
+		t.Errorf("Expected wrappers in order, but got %v", order)
+	}
+	if seen == nil || seen.Action != "Service1" || seen.Method != "Multiply" || string(*seen.Tid) != "1" ||
+		string(seen.Data) != `[{"A":4,"B":2}]` || seen.Request == nil || seen.Err != nil {
+		t.Fatalf("Expected the parsed call, but got %+v", seen)
+	}
+	if r, ok := seenEnv.Result.(*Service1Response); !ok || r.Result != 8 || seenEnv.Extra["sig"] != "abc" {
+		t.Errorf("Expected the final envelope, but got %+v", seenEnv)
+	}
+	if !strings.Contains(w.Body.String(), `"sig":"abc"`) {
+		t.Errorf("Expected the modified envelope, but got %q", w.Body.String())
+	}
+
+	order = nil
+	serve(s, newRequest(`{"action":"Service1","method":"ResponseError","type":"rpc","tid":2,"data":[{"A":4,"B":2}]}`))
+	if seen.Err == nil || seenEnv.Type != "exception" {
+		t.Errorf("Expected the exception, but got %+v %+v", seen, seenEnv)
+	}
+}
+
+func TestTypeCase(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		var opts []Option
+		if strict {
+			opts = append(opts, WithStrictType())
+		}
+		s := rpc.NewServer()
+		s.RegisterCodec(NewCodec(opts...), "application/json")
+		s.RegisterService(new(Service1), "")
+
+		for _, typ := range []string{"rpc", "RPC", "Rpc"} {
+			w := serve(s, newRequest(`{"action":"Service1","method":"Multiply","type":"`+typ+`","tid":1,"data":[{"A":4,"B":2}]}`))
+			if accepted := strings.Contains(w.Body.String(), `"type":"rpc"`); accepted != (!strict || typ == "rpc") {
+				t.Errorf("Unexpected response to type %q, strict %v: %v %q", typ, strict, w.Code, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	for version, want := range map[string]string{"": "", "3": `"schemaVersion":"3"`} {
+		s := rpc.NewServer()
+		s.RegisterCodec(NewCodec(WithSchemaVersion(version)), "application/json")
+		s.RegisterService(new(Service1), "")
+		for _, method := range []string{"Multiply", "ResponseError"} {
+			w := serve(s, newRequest(`{"action":"Service1","method":"`+method+`","type":"rpc","tid":1,"data":[{"A":4,"B":2}]}`))
+			if got := strings.Contains(w.Body.String(), "schemaVersion"); got != (want != "") || !strings.Contains(w.Body.String(), want) {
+				t.Errorf("Expected %q in the %s envelope, but got %q", want, method, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestMethodDefaults(t *testing.T) {
+	reg := NewRegistry()
+	reg.Add("Service1", "Multiply").Defaults = map[string]interface{}{"A": 3, "B": 5}
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithRegistry(reg)), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	for data, want := range map[string]int{
+		`[{"A":4,"B":2}]`: 8,
+		`[{"A":4}]`:       20,
+		`[{}]`:            15,
+		`null`:            15,
+	} {
+		var res Service1Response
+		w := serve(s, newRequest(`{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":`+data+`}`))
+		if err := DecodeClientResponse(w.Body, &res); err != nil || res.Result != want {
+			t.Errorf("Expected %d for data %s, but got %v %v", want, data, res.Result, err)
+		}
+	}
+}
+
+type Import struct {
+	heap uint64
+}
+
+func (s *Import) Rows(r *http.Request, rows *ParamStream, res *int) error {
+	var row struct{ ID int }
+	for rows.Next(&row) {
+		*res += row.ID
+		if row.ID == 100000 {
+			runtime.GC()
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			s.heap = m.HeapAlloc
+		}
+	}
+	return rows.Err()
+}
+
+// rowsReader generates the body of an Import.Rows call with n rows, without
+// holding it in memory.
+type rowsReader struct {
+	n, i int
+	buf  []byte
+}
+
+func (r *rowsReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		switch {
+		case r.i == 0:
+			r.buf = []byte(`{"action":"Import","method":"Rows","type":"rpc","data":[[`)
+		case r.i <= r.n:
+			r.buf = []byte(fmt.Sprintf(`{"ID":%d,"Name":"row %[1]d padded to make the body larger"}`, r.i))
+			if r.i < r.n {
+				r.buf = append(r.buf, ',')
+			}
+		case r.i == r.n+1:
+			r.buf = []byte(`]],"tid":7}`)
+		default:
+			return 0, io.EOF
+		}
+		r.i++
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func TestStreamDecode(t *testing.T) {
+	reg := NewRegistry()
+	reg.Add("Import", "Rows").Stream = true
+	imp := new(Import)
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithRegistry(reg)), "application/json")
+	if err := reg.RegisterService(s, imp, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 200000
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", &rowsReader{n: n})
+	r.Header.Set("Content-Type", "application/json")
+	w := serve(s, r)
+	if want := fmt.Sprintf(`"result":%d`, n*(n+1)/2); !strings.Contains(w.Body.String(), want) || !strings.Contains(w.Body.String(), `"tid":7`) {
+		t.Fatalf("Expected %s for tid 7, but got %q", want, w.Body.String())
+	}
+	// The body is about 12MB.
+	if imp.heap == 0 || imp.heap > 4<<20 {
+		t.Errorf("Expected the rows to be decoded with bounded memory, but the heap was %d bytes", imp.heap)
+	}
+
+	// Elements left unread are skipped and other methods are not streamed.
+	w = serve(s, newRequest(`{"action":"Import","method":"Rows","type":"rpc","data":null,"tid":8}`))
+	if !strings.Contains(w.Body.String(), `"result":0`) || !strings.Contains(w.Body.String(), `"tid":8`) {
+		t.Errorf("Expected an empty stream, but got %q", w.Body.String())
+	}
+	w = serve(s, newRequest(`{"action":"Import","method":"Rows","type":"rpc","data":[{"ID":1}],"tid":9}`))
+	if !strings.Contains(w.Body.String(), "streamed data must be an array") {
+		t.Errorf("Expected ill-formed stream data, but got %q", w.Body.String())
+	}
+}
+
+func TestStreamChecks(t *testing.T) {
+	reg := NewRegistry()
+	reg.Add("Import", "Rows").Stream = true
+	for _, test := range []struct {
+		opts  []Option
+		max   int
+		body  string
+		wants string
+	}{
+		// Data decoded before the method is known cannot be streamed.
+		{nil, 0, `{"data":[[{"ID":1},{"ID":2}]],"action":"Import","method":"Rows","type":"rpc","tid":1}`, errStreamOrder.Error()},
+		{nil, 20, `{"action":"Import","method":"Rows","type":"rpc","tid":1,"data":[[{"ID":1},{"ID":2},{"ID":3}]]}`, ErrDataTooLarge.Error()},
+		{nil, 40, `{"action":"Import","method":"Rows","type":"rpc","tid":1,"data":[[{"ID":1},{"ID":2},{"ID":3}]]}`, `"result":6`},
+		{[]Option{WithStrictTid()}, 0, `{"action":"Import","method":"Rows","type":"rpc","data":[[{"ID":1}]],"tid":1}`, errStreamTid.Error()},
+		{[]Option{WithStrictTid()}, 0, `{"action":"Import","method":"Rows","type":"rpc","tid":{},"data":[[{"ID":1}]]}`, "tid must be a number"},
+		{[]Option{WithCanonicalTid()}, 0, `{"action":"Import","method":"Rows","type":"rpc","tid":1,"data":[[{"ID":1}]]}`, `"result":1`},
+		{[]Option{WithCrypto(func(b []byte) ([]byte, error) { return b, nil }, nil)}, 0,
+			`{"action":"Import","method":"Rows","type":"rpc","tid":1,"data":[[{"ID":1}]]}`, errStreamDecrypt.Error()},
+		// Members are matched like encoding/json matches them.
+		{nil, 0, `{"ACTION":"Import","Method":"Rows","extra":{"a":[1]},"type":"rpc","Tid":7,"data":[[{"ID":1}]]}`, `"tid":7`},
+	} {
+		reg.Lookup("Import", "Rows").MaxDataSize = test.max
+		s := rpc.NewServer()
+		s.RegisterCodec(NewCodec(append(test.opts, WithRegistry(reg))...), "application/json")
+		s.RegisterService(new(Import), "")
+		if w := serve(s, newRequest(test.body)); !strings.Contains(w.Body.String(), test.wants) {
+			t.Errorf("Expected %q for %s, but got %v %q", test.wants, test.body, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRequestField(t *testing.T) {
+	typ := reflect.TypeOf(serverRequest{})
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if name := strings.Split(f.Tag.Get("json"), ",")[0]; f.PkgPath == "" && requestField(new(serverRequest), name) == nil {
+			t.Errorf("Expected the %s member to be decoded from streams", name)
+		}
+	}
+}
+
+func TestCorrelationPath(t *testing.T) {
+	var logs bytes.Buffer
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithCorrelationPath("0.ctx.ids.1"), WithErrorReference(),
+		WithLogger(log.New(&logs, "", 0))), "application/json")
+	s.RegisterService(new(Trace), "")
+	s.RegisterService(new(Service1), "")
+
+	w := serve(s, newRequest(`{"action":"Trace","method":"Correlation","type":"rpc","tid":1,"data":[{"ctx":{"ids":["a","corr-42"]}}]}`))
+	var env struct {
+		Result string
+		Meta   map[string]interface{}
+	}
+	json.Unmarshal(w.Body.Bytes(), &env)
+	if env.Result != "corr-42" || env.Meta["correlationId"] != "corr-42" {
+		t.Errorf("Expected correlation id corr-42, but got %q", w.Body.String())
+	}
+
+	w = serve(s, newRequest(`{"action":"Trace","method":"Correlation","type":"rpc","tid":2,"data":[{"ctx":{"ids":["a"]}}]}`))
+	if strings.Contains(w.Body.String(), "correlationId") || !strings.Contains(w.Body.String(), `"result":""`) {
+		t.Errorf("Expected no correlation id, but got %q", w.Body.String())
+	}
+
+	serve(s, newRequest(`{"action":"Service1","method":"ResponseError","type":"rpc","tid":3,"data":[{"A":1,"ctx":{"ids":[0,7]}}]}`))
+	if !strings.Contains(logs.String(), "(correlation id 7)") {
+		t.Errorf("Expected the correlation id in the logs, but got %q", logs.String())
+	}
+}
+
+type Shop struct{}
+
+func (s *Shop) Buy(r *http.Request, req *int, res *Event) error {
+	if *req > 0 {
+		*res = Event{Name: "stock", Data: map[string]int{"qty": *req}}
+	}
+	return nil
+}
+
+func TestEventResult(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Shop), "")
+
+	w := serve(s, newRequest(`{"action":"Shop","method":"Buy","type":"rpc","tid":4,"data":[3]}`))
+	var env map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &env)
+	if env["type"] != "event" || env["name"] != "stock" || env["tid"] != float64(4) || env["action"] != "Shop" {
+		t.Errorf("Expected a stock event envelope, but got %q", w.Body.String())
+	}
+	if data, _ := env["data"].(map[string]interface{}); data["qty"] != float64(3) {
+		t.Errorf("Expected the event data, but got %q", w.Body.String())
+	}
+	if _, ok := env["result"]; ok {
+		t.Errorf("Expected no result in an event envelope, but got %q", w.Body.String())
+	}
+
+	w = serve(s, newRequest(`{"action":"Shop","method":"Buy","type":"rpc","tid":5,"data":[0]}`))
+	if !strings.Contains(w.Body.String(), `"type":"rpc"`) || !strings.Contains(w.Body.String(), `"result":{`) {
+		t.Errorf("Expected an unnamed event to be a result, but got %q", w.Body.String())
+	}
+}
+
+func TestBindingHint(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Numbers), "")
+	s.RegisterService(new(Service1), "")
+
+	for _, call := range []string{
+		`"binding":"positional","data":[[1,2,3]]`,
+		`"binding":"named","data":[1,2,3]`,
+	} {
+		var res int
+		w := serve(s, newRequest(`{"action":"Numbers","method":"Sum","type":"rpc","tid":1,`+call+`}`))
+		if err := DecodeClientResponse(w.Body, &res); err != nil || res != 6 {
+			t.Errorf("Expected sum 6 for %s, but got %v %v", call, res, err)
+		}
+	}
+
+	// Without a hint the shape of the data decides.
+	for _, data := range []string{`[{"A":4,"B":2}]`, `{"A":4,"B":2}`} {
+		var res Service1Response
+		w := serve(s, newRequest(`{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":`+data+`}`))
+		if err := DecodeClientResponse(w.Body, &res); err != nil || res.Result != 8 {
+			t.Errorf("Expected 8 for data %s, but got %v %v", data, res.Result, err)
+		}
+	}
+
+	w := serve(s, newRequest(`{"action":"Numbers","method":"Sum","type":"rpc","tid":1,"binding":"keyword","data":[1]}`))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "unknown binding") {
+		t.Errorf("Expected an unknown binding error, but got %v %q", w.Code, w.Body.String())
+	}
+}
+
+type Search struct{}
+
+func (s *Search) Find(r *http.Request, req *struct{ Query, Q string }, res *string) error {
+	if req.Q != "" {
+		Deprecate(r.Context(), "Q", "use Query instead")
+		Deprecate(r.Context(), "Q", "use Query instead")
+		req.Query = req.Q
+	}
+	*res = req.Query
+	return nil
+}
+
+func TestDeprecationNotices(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		var opts []Option
+		if enabled {
+			opts = append(opts, WithDeprecationNotices())
+		}
+		s := rpc.NewServer()
+		s.RegisterCodec(NewCodec(opts...), "application/json")
+		s.RegisterService(new(Search), "")
+
+		w := serve(s, newRequest(`{"action":"Search","method":"Find","type":"rpc","tid":1,"data":[{"Q":"go"}]}`))
+		want := `"meta":{"deprecations":[{"field":"Q","message":"use Query instead"}]}`
+		if strings.Contains(w.Body.String(), want) != enabled || !strings.Contains(w.Body.String(), `"result":"go"`) {
+			t.Errorf("Unexpected response with notices enabled %v: %q", enabled, w.Body.String())
+		}
+		w = serve(s, newRequest(`{"action":"Search","method":"Find","type":"rpc","tid":2,"data":[{"Query":"go"}]}`))
+		if strings.Contains(w.Body.String(), "deprecations") {
+			t.Errorf("Expected no notices, but got %q", w.Body.String())
+		}
+	}
+}
+
+type TicketStatus int
+
+func (s TicketStatus) String() string {
+	return [...]string{"new", "open", "closed"}[s]
+}
+
+type Ticket struct {
+	ID      int
+	Status  TicketStatus `json:"status"`
+	History []TicketStatus
+	Owner   *string `json:",omitempty"`
+	Created time.Time
+}
+
+type Tickets struct{}
+
+func (s *Tickets) Get(r *http.Request, req *int, res *Ticket) error {
+	*res = Ticket{ID: *req, Status: 1, History: []TicketStatus{0, 1}, Created: catalogModified}
+	return nil
+}
+
+func (s *Tickets) Statuses(r *http.Request, req *int, res *map[string][]TicketStatus) error {
+	*res = map[string][]TicketStatus{"7": {0, 1}}
+	return nil
+}
+
+type ticketBase struct {
+	A int
+}
+
+type ticketEnums struct {
+	S TicketStatus
+}
+
+type ticketKey struct {
+	k string
+}
+
+func (k ticketKey) MarshalText() ([]byte, error) {
+	return []byte(k.k), nil
+}
+
+func TestEnumStrings(t *testing.T) {
+	for _, test := range []struct {
+		opts   []Option
+		method string
+		want   string
+	}{
+		{nil, "Get", `"result":{"ID":7,"status":1,"History":[0,1],"Created":"2016-10-03T12:00:00Z"}`},
+		{nil, "Statuses", `"result":{"7":[0,1]}`},
+		{[]Option{WithEnumStrings(TicketStatus(0))}, "Get", `"result":{"ID":7,"status":"open","History":["new","open"],"Created":"2016-10-03T12:00:00Z"}`},
+		{[]Option{WithEnumStrings(TicketStatus(0))}, "Statuses", `"result":{"7":["new","open"]}`},
+	} {
+		s := rpc.NewServer()
+		s.RegisterCodec(NewCodec(test.opts...), "application/json")
+		s.RegisterService(new(Tickets), "")
+		w := serve(s, newRequest(`{"action":"Tickets","method":"`+test.method+`","type":"rpc","tid":1,"data":[7]}`))
+		if !strings.Contains(w.Body.String(), test.want) {
+			t.Errorf("Expected %s, but got %q", test.want, w.Body.String())
+		}
+	}
+
+	c := NewCodec(WithEnumStrings(TicketStatus(0)))
+	cyclic := []interface{}{TicketStatus(1), nil}
+	cyclic[1] = cyclic
+	for _, test := range []struct {
+		reply interface{}
+		want  string
+	}{
+		{TicketStatus(1), `"open"`},
+		{&[]interface{}{TicketStatus(0), "x", nil}, `["new","x",null]`},
+		{map[ticketKey]TicketStatus{{"k"}: 1}, `{"k":"open"}`},
+		{struct {
+			Ticket
+			Status TicketStatus
+			Hidden TicketStatus  `json:"-"`
+			Next   *TicketStatus `json:"next,omitempty"`
+			Any    interface{}
+		}{Ticket{ID: 3, Status: 2}, 1, 1, nil, TicketStatus(2)}, `{"ID":3,"status":"closed","History":null,"Created":"0001-01-01T00:00:00Z","Status":"open","Any":"closed"}`},
+		{struct {
+			*ticketEnums
+			B TicketStatus
+		}{&ticketEnums{1}, 2}, `{"S":"open","B":"closed"}`},
+		{struct {
+			*ticketBase
+			S TicketStatus `json:",string"`
+		}{&ticketBase{1}, 1}, `{"A":1,"S":"1"}`},
+	} {
+		if b, err := c.encodeResult(test.reply); err != nil || string(b) != test.want {
+			t.Errorf("Expected %s for %#v, but got %s %v", test.want, test.reply, b, err)
+		}
+	}
+	if _, err := c.encodeResult(cyclic); err != errCyclicResult {
+		t.Errorf("Expected a cyclic result error, but got %v", err)
+	}
+}
+
+func TestServedBy(t *testing.T) {
+	body := `{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":[{"A":4,"B":2}]}`
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithServedBy("web-3"), WithDebug()), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	w := serve(s, newRequest(body))
+	if h := w.Header().Get("X-Served-By"); h != "web-3" {
+		t.Errorf("Expected X-Served-By web-3, but got %q", h)
+	}
+	var env struct {
+		Meta map[string]interface{}
+	}
+	json.Unmarshal(w.Body.Bytes(), &env)
+	if env.Meta["server"] != "web-3" {
+		t.Errorf("Expected meta.server web-3, but got %v", env.Meta)
+	}
+
+	host, _ := os.Hostname()
+	s = rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithServedBy("")), "application/json")
+	s.RegisterService(new(Service1), "")
+	if h := serve(s, newRequest(body)).Header().Get("X-Served-By"); h != host {
+		t.Errorf("Expected X-Served-By %q, but got %q", host, h)
+	}
+}
+
+// xorCipher is a toy cipher for tests. Ciphertexts are sent as base64 JSON
+// strings.
+type xorCipher byte
+
+func (x xorCipher) xor(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[i] = b[i] ^ byte(x)
+	}
+	return out
+}
+
+func (x xorCipher) encrypt(b []byte) ([]byte, error) {
+	return json.Marshal(x.xor(b))
+}
+
+func (x xorCipher) decrypt(b []byte) ([]byte, error) {
+	var ciphertext []byte
+	if err := json.Unmarshal(b, &ciphertext); err != nil {
+		return nil, err
+	}
+	return x.xor(ciphertext), nil
+}
+
+func TestCrypto(t *testing.T) {
+	cipher := xorCipher(0x5a)
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithCrypto(cipher.decrypt, cipher.encrypt)), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	data, _ := cipher.encrypt([]byte(`[{"A":4,"B":2}]`))
+	w := serve(s, newRequest(`{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":`+string(data)+`}`))
+	var env struct {
+		Result json.RawMessage
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+		t.Fatalf("Expected an envelope, but got %q", w.Body.String())
+	}
+	if bytes.Contains(env.Result, []byte("Result")) {
+		t.Errorf("Expected an encrypted result, but got %s", env.Result)
+	}
+	plain, err := cipher.decrypt(env.Result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res Service1Response
+	if err := json.Unmarshal(plain, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected decrypted result 8, but got %s", plain)
+	}
+}
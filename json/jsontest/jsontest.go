@@ -0,0 +1,125 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package jsontest provides helpers for testing ExtDirect services.
+package jsontest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	rpcjson "github.com/r0123r/rpc/json"
+)
+
+// AssertEnvelope reports an error through t if the envelope encoded in got
+// differs from want.
+//
+// The envelopes are compared as parsed JSON, so whitespace and field order
+// do not matter. want is encoded as the codec would write it, so only the
+// fields set in want are expected besides type, tid, action and method.
+// Mismatches are reported field by field.
+func AssertEnvelope(t testing.TB, got []byte, want rpcjson.Envelope) {
+	b, err := json.Marshal(&want)
+	if err != nil {
+		t.Errorf("jsontest: cannot encode the wanted envelope: %v", err)
+		return
+	}
+	var g, w map[string]interface{}
+	if err := decode(got, &g); err != nil {
+		t.Errorf("jsontest: got an invalid envelope %q: %v", got, err)
+		return
+	}
+	decode(b, &w)
+	if diff := diff(g, w); diff != "" {
+		t.Errorf("jsontest: envelope mismatch (got, want):\n%s", diff)
+	}
+}
+
+// decode decodes a JSON object, keeping numbers exact.
+func decode(b []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+// diff returns the fields that differ between got and want, one per line,
+// or an empty string if they are equal.
+func diff(got, want map[string]interface{}) string {
+	keys := make([]string, 0, len(got)+len(want))
+	for k := range got {
+		keys = append(keys, k)
+	}
+	for k := range want {
+		if _, ok := got[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var lines []string
+	for _, k := range keys {
+		g, gok := got[k]
+		w, wok := want[k]
+		switch {
+		case !wok:
+			lines = append(lines, fmt.Sprintf("\t%s: unexpected %s", k, compact(g)))
+		case !gok:
+			lines = append(lines, fmt.Sprintf("\t%s: missing, want %s", k, compact(w)))
+		case !equal(g, w):
+			lines = append(lines, fmt.Sprintf("\t%s: %s, want %s", k, compact(g), compact(w)))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// equal reports whether two decoded JSON values are equal. Numbers are
+// compared by value, so that 8 equals 8.0.
+func equal(a, b interface{}) bool {
+	if an, ok := a.(json.Number); ok {
+		if bn, ok := b.(json.Number); ok {
+			af, aerr := an.Float64()
+			bf, berr := bn.Float64()
+			return aerr == nil && berr == nil && af == bf
+		}
+		return false
+	}
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			if w, ok := b[k]; !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compact returns the JSON encoding of a decoded value.
+func compact(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
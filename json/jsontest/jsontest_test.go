@@ -0,0 +1,77 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jsontest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	rpcjson "github.com/r0123r/rpc/json"
+)
+
+// recorder records the errors reported by AssertEnvelope.
+type recorder struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func want() rpcjson.Envelope {
+	tid := json.RawMessage(`7`)
+	return rpcjson.Envelope{
+		Type:   "rpc",
+		Action: "Service1",
+		Method: "Multiply",
+		Id:     &tid,
+		Result: map[string]int{"Result": 8},
+	}
+}
+
+func TestAssertEnvelopeMatch(t *testing.T) {
+	got := `{
+		"tid": 7.0,
+		"result": {"Result": 8},
+		"method": "Multiply",
+		"type": "rpc",
+		"action": "Service1"
+	}`
+	r := &recorder{TB: t}
+	AssertEnvelope(r, []byte(got), want())
+	if len(r.errors) != 0 {
+		t.Errorf("Expected envelopes to match, but got %v", r.errors)
+	}
+}
+
+func TestAssertEnvelopeMismatch(t *testing.T) {
+	got := `{"type":"rpc","tid":7,"action":"Service1","method":"multiply","result":{"Result":9},"meta":{"server":"web-1"}}`
+	r := &recorder{TB: t}
+	AssertEnvelope(r, []byte(got), want())
+	if len(r.errors) != 1 {
+		t.Fatalf("Expected a mismatch error, but got %v", r.errors)
+	}
+	for _, line := range []string{
+		`meta: unexpected {"server":"web-1"}`,
+		`method: "multiply", want "Multiply"`,
+		`result: {"Result":9}, want {"Result":8}`,
+	} {
+		if !strings.Contains(r.errors[0], line) {
+			t.Errorf("Expected %q in the diff, but got %q", line, r.errors[0])
+		}
+	}
+	if strings.Contains(r.errors[0], "tid") || strings.Contains(r.errors[0], "action") {
+		t.Errorf("Expected only mismatching fields in the diff, but got %q", r.errors[0])
+	}
+
+	r = &recorder{TB: t}
+	AssertEnvelope(r, []byte(`{"type":"rpc"`), want())
+	if len(r.errors) != 1 || !strings.Contains(r.errors[0], "invalid envelope") {
+		t.Errorf("Expected an invalid envelope error, but got %v", r.errors)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// MetricsHandler returns a handler exposing the codec Stats in the
+// Prometheus text exposition format, for scraping without depending on the
+// Prometheus client library. The metrics are:
+//
+//	rpc_requests_total              calls dispatched to methods
+//	rpc_errors_total                calls whose method returned an error
+//	rpc_sla_violations_total        calls exceeding the SLA of their method
+//	rpc_request_duration_seconds    histogram of the call durations
+func (c *Codec) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := c.Stats()
+		var b bytes.Buffer
+		counter := func(name, help string, v uint64) {
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+		}
+		counter("rpc_requests_total", "Calls dispatched to methods.", s.Requests)
+		counter("rpc_errors_total", "Calls whose method returned an error.", s.Errors)
+		counter("rpc_sla_violations_total", "Calls exceeding the SLA of their method.", s.SLAViolations)
+
+		const h = "rpc_request_duration_seconds"
+		fmt.Fprintf(&b, "# HELP %s Duration of the calls.\n# TYPE %s histogram\n", h, h)
+		for i, bound := range durationBounds {
+			le := strconv.FormatFloat(bound.Seconds(), 'g', -1, 64)
+			fmt.Fprintf(&b, "%s_bucket{le=\"%s\"} %d\n", h, le, s.DurationBuckets[i])
+		}
+		fmt.Fprintf(&b, "%s_bucket{le=\"+Inf\"} %d\n", h, s.Requests)
+		fmt.Fprintf(&b, "%s_sum %s\n", h, strconv.FormatFloat(s.Duration.Seconds(), 'g', -1, 64))
+		fmt.Fprintf(&b, "%s_count %d\n", h, s.Requests)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(b.Bytes())
+	})
+}
@@ -0,0 +1,36 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"encoding/json"
+)
+
+// MutationResult is the reply of insert, update and delete methods, telling
+// clients which records to update in their local stores. It is encoded
+// under "result" as:
+//
+//	{"affected":2,"ids":[41,42]}
+//
+// ids is always an array, empty when the method reports no ids.
+type MutationResult struct {
+	// Affected is the number of records inserted, updated or deleted.
+	Affected int
+	// IDs are the ids of the affected records, such as the ids assigned to
+	// inserted records.
+	IDs []interface{}
+}
+
+// MarshalJSON encodes the result.
+func (m MutationResult) MarshalJSON() ([]byte, error) {
+	ids := m.IDs
+	if ids == nil {
+		ids = []interface{}{}
+	}
+	return json.Marshal(map[string]interface{}{
+		"affected": m.Affected,
+		"ids":      ids,
+	})
+}
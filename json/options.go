@@ -0,0 +1,650 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"time"
+)
+
+// Option configures a Codec.
+type Option func(*Codec)
+
+// WithStrictTid makes the codec reject requests whose tid is not a JSON
+// number or string. A missing or null tid is still accepted.
+func WithStrictTid() Option {
+	return func(c *Codec) {
+		c.strictTid = true
+	}
+}
+
+// WithCanonicalTid makes the codec store the tid of calls in their context
+// in a canonical string form, returned by TidFromContext, for logging and
+// correlation: string tids are kept as is and numeric tids take their
+// shortest decimal form. Responses still echo the tid as sent. Requests
+// whose tid is neither a number nor a non-empty string are rejected.
+func WithCanonicalTid() Option {
+	return func(c *Codec) {
+		c.canonicalTid = true
+	}
+}
+
+// WithZeroFillMissingArgs makes the codec accept an empty data array,
+// leaving the method arguments with their zero value. By default an empty
+// data array is rejected.
+func WithZeroFillMissingArgs() Option {
+	return func(c *Codec) {
+		c.zeroFill = true
+	}
+}
+
+// WithDebug enables debug mode. Envelopes then carry debugging
+// information under "meta", such as meta.timing, and exceptions carry the
+// stack where their error was created under "where", for errors made with
+// NewStackError and panics recovered by a Router. Debug mode should not be
+// enabled in production.
+func WithDebug() Option {
+	return func(c *Codec) {
+		c.debug = true
+	}
+}
+
+// WithEchoParams makes envelopes echo the data of their call under
+// meta.params in debug mode, as bound to the method arguments, to help
+// diagnose client serialization issues. It has no effect outside debug
+// mode.
+func WithEchoParams() Option {
+	return func(c *Codec) {
+		c.echoParams = true
+	}
+}
+
+// WithStackCapture sets whether exceptions carry the stack of their error
+// under "where" in debug mode. It is enabled by default; disabling it
+// avoids the cost of recording a stack for every error, NewStackError then
+// recording none, while keeping the other debugging information.
+func WithStackCapture(enabled bool) Option {
+	return func(c *Codec) {
+		c.noStack = !enabled
+	}
+}
+
+// WithRejectEmptyBatch sets whether a Router rejects requests holding an
+// empty batch, "[]", which usually is a client bug. They are rejected by
+// default with an ErrEmptyBatch exception and a 400 status; when allowed
+// they are answered with an empty array.
+func WithRejectEmptyBatch(reject bool) Option {
+	return func(c *Codec) {
+		c.allowEmptyBatch = !reject
+	}
+}
+
+// WithCaseInsensitive makes the codec match action and method names sent
+// by clients against the registry regardless of case. The registered names
+// are the canonical ones used for dispatch, so every method must be added
+// to the registry with the case it has in the rpc server.
+func WithCaseInsensitive() Option {
+	return func(c *Codec) {
+		c.caseInsensitive = true
+	}
+}
+
+// WithStrictType makes the codec reject requests whose type is not exactly
+// "rpc". By default the type is matched case-insensitively, so that "RPC"
+// or "Rpc" is accepted and answered as "rpc".
+func WithStrictType() Option {
+	return func(c *Codec) {
+		c.strictType = true
+	}
+}
+
+// WithStrictShape makes a Router reject with an exception requests whose
+// X-RPC-Batch header claims a batch for a single call, or a single call for
+// a batch. By default the shape of the body wins.
+func WithStrictShape() Option {
+	return func(c *Codec) {
+		c.strictShape = true
+	}
+}
+
+// WithNotificationStatus sets the HTTP status code of the empty responses
+// answering notifications, such as 202 for fire-and-forget calls. It
+// defaults to 200.
+func WithNotificationStatus(code int) Option {
+	return func(c *Codec) {
+		c.notificationStatus = code
+	}
+}
+
+// WithResponseStatus sets the HTTP status code of responses carrying a
+// result or method exception envelope. It defaults to 200.
+func WithResponseStatus(code int) Option {
+	return func(c *Codec) {
+		c.responseStatus = code
+	}
+}
+
+// WithStrictContentLength makes the codec reject with ErrContentLength
+// requests whose body length differs from the declared Content-Length,
+// instead of decoding a possibly truncated body.
+func WithStrictContentLength() Option {
+	return func(c *Codec) {
+		c.strictLength = true
+	}
+}
+
+// WithFloatFormat makes the codec write the fractional numbers of results
+// in non-exponential notation with prec decimal places, or with the fewest
+// digits representing them exactly if prec is negative. Integers are not
+// affected. By default floats are written as encoding/json does, which
+// uses exponents for very large and very small values.
+func WithFloatFormat(prec int) Option {
+	return func(c *Codec) {
+		c.floatPrec = &prec
+	}
+}
+
+// WithEnumStrings makes the codec write the values of the types of enums
+// found in results as the names returned by their String method instead of
+// as numbers, for readability on the client. Each enum is a value of a
+// type to register, such as Status(0). By default results are written as
+// encoding/json does.
+//
+// Enums are found in the result itself and in the pointers, slices, arrays,
+// maps, interfaces and struct fields it is made of, unless they have their
+// own JSON encoding. Struct fields keep the names and the omitempty and "-"
+// options of their json tags, and fields promoted from embedded structs are
+// written in their place. Fields with the string option are written as
+// encoding/json does.
+func WithEnumStrings(enums ...fmt.Stringer) Option {
+	return func(c *Codec) {
+		if c.enums == nil {
+			c.enums = make(map[reflect.Type]bool)
+		}
+		for _, e := range enums {
+			c.enums[reflect.TypeOf(e)] = true
+		}
+	}
+}
+
+// WithErrorReference tags the exceptions returned by methods with a short
+// reference id, appended to the message and set as meta.ref. The id is
+// logged along with the error so that support can find it in the logs.
+func WithErrorReference() Option {
+	return func(c *Codec) {
+		c.errorRef = true
+	}
+}
+
+// WithMethodValidation makes the codec reject calls to methods missing
+// from the registry before dispatching them. A Router answers them with an
+// exception naming the offending action and method, instead of the generic
+// error of the rpc server.
+func WithMethodValidation() Option {
+	return func(c *Codec) {
+		c.validateMethods = true
+	}
+}
+
+// WithUnwrapStringData makes the codec accept data sent as a string holding
+// JSON, as buggy clients encoding it twice do. Only a string data holding a
+// JSON array or object is unwrapped; strings nested in the data array are
+// never touched, so genuine string arguments are not affected.
+func WithUnwrapStringData() Option {
+	return func(c *Codec) {
+		c.unwrapData = true
+	}
+}
+
+// WithQualifiedMethods makes the codec accept calls sending an empty action
+// and the fully-qualified method name as method, such as "Users.load",
+// splitting the name at its last dot. Calls with an action are not
+// affected. Envelopes answering such calls carry the split names.
+func WithQualifiedMethods() Option {
+	return func(c *Codec) {
+		c.qualifiedMethods = true
+	}
+}
+
+// WithServedBy tags every response with an X-Served-By header naming the
+// serving instance, which helps debugging load balanced deployments. An
+// empty name uses the host name. In debug mode the name is also set as
+// meta.server.
+func WithServedBy(name string) Option {
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	return func(c *Codec) {
+		c.servedBy = name
+	}
+}
+
+// WithRequestID assigns every request an id, available to methods through
+// RequestIDFromContext. The id set by an upstream gateway in the
+// X-Request-Id header is reused; one is generated only when it is absent.
+// If echo is true the id is also set as the X-Request-Id response header.
+func WithRequestID(echo bool) Option {
+	return func(c *Codec) {
+		c.requestIDs = true
+		c.echoID = echo
+	}
+}
+
+// WithCorrelationPath makes the codec extract an application correlation
+// id from the data of calls, at path, without it being a method argument.
+// The id is returned by CorrelationIDFromContext, echoed as
+// meta.correlationId and added to the log messages about the call.
+//
+// path is a dot separated list of object keys and array indexes into the
+// data array: "0.meta.correlationId" selects the correlationId member of
+// the meta object of the first argument. Keys made of digits are array
+// indexes. Strings are used as is and numbers and booleans as encoded;
+// calls without a scalar at path have no correlation id.
+func WithCorrelationPath(path string) Option {
+	return func(c *Codec) {
+		c.correlationPath = path
+	}
+}
+
+// WithRegistry sets the registry holding per-method settings.
+func WithRegistry(r *Registry) Option {
+	return func(c *Codec) {
+		c.registry = r
+	}
+}
+
+// WithOmitEmpty makes envelopes omit their optional top-level fields, such
+// as those added through Envelope.Extra, when they are null, empty strings
+// or empty arrays and objects, for bandwidth sensitive clients. The type,
+// tid, action, method, result and message fields are always written.
+func WithOmitEmpty() Option {
+	return func(c *Codec) {
+		c.omitEmpty = true
+	}
+}
+
+// WithDeprecationNotices makes the codec return the notices recorded by
+// methods with Deprecate under meta.deprecations, as an array of objects
+// with "field" and "message" members, so that clients can migrate off
+// deprecated fields. Without it the notices are discarded.
+func WithDeprecationNotices() Option {
+	return func(c *Codec) {
+		c.deprecations = true
+	}
+}
+
+// WithSchemaVersion makes the codec write version as the schemaVersion
+// field of every envelope, so that clients can detect changes of the
+// envelope format across server upgrades and warn on a mismatch.
+func WithSchemaVersion(version string) Option {
+	return func(c *Codec) {
+		c.schemaVersion = version
+	}
+}
+
+// WithEnvelopeFinalizer sets a function called with every envelope just
+// before it is encoded, both for results and exceptions. It may modify the
+// envelope, e.g. to add top-level fields through Extra.
+func WithEnvelopeFinalizer(f func(env *Envelope)) Option {
+	return func(c *Codec) {
+		c.finalizer = f
+	}
+}
+
+// WithEnvelopeWrapper adds a wrapper around the building of the envelopes
+// answering calls, for concerns such as auditing or signing that need both
+// the call and its envelope. f receives next, the function returning the
+// envelope of a call, and returns the function the codec uses instead: it
+// can inspect the call, call next, then observe or modify the envelope, or
+// return its own.
+//
+// Wrappers run once the method returned, with its reply and error in the
+// call, so they cannot time the method or keep it from running: that is
+// done by wrapping the handler serving the calls, or the methods
+// themselves. Wrappers run in the order they were added, the first one
+// outermost. next builds the envelope with the exception details, error
+// reference, debug meta and result encoding set by the other options. The
+// envelope finalizer, the response rewrite and the encoders then apply to
+// the envelope returned by the outermost wrapper. Wrappers are not called
+// for responses without an envelope, such as notifications, downloads and
+// 304 Not Modified, nor for calls rejected before dispatch.
+func WithEnvelopeWrapper(f func(next EnvelopeFunc) EnvelopeFunc) Option {
+	return func(c *Codec) {
+		c.around = append(c.around, f)
+	}
+}
+
+// WithLogger sets the logger used for warnings. By default the standard
+// logger is used.
+func WithLogger(l *log.Logger) Option {
+	return func(c *Codec) {
+		c.logger = l
+	}
+}
+
+// WithTokenAuth makes the codec authenticate every request with the bearer
+// token found in the Authorization header. The resolved principal is
+// available to methods through PrincipalFromContext.
+//
+// Requests failing authentication are not dispatched. A Router answers
+// them with a 401 exception.
+func WithTokenAuth(f func(token string) (Principal, error)) Option {
+	return func(c *Codec) {
+		c.tokenAuth = f
+	}
+}
+
+// WithDedupe makes a Router answer identical calls received within window
+// with the response of the first one, without dispatching them again. A
+// call arriving while the first is still running waits for its response.
+//
+// Calls are identified by key, or by DefaultDedupeKey if key is nil, which
+// only deduplicates the calls of authenticated principals.
+func WithDedupe(window time.Duration, key DedupeKeyFunc) Option {
+	return func(c *Codec) {
+		c.dedupe = newDedupe(window, key)
+	}
+}
+
+// WithDuplicateAck makes calls deduplicated with WithDedupe answered with
+// the lightweight result {"duplicate":true} instead of the response of the
+// first call, for clients that only need an acknowledgement. Replays of
+// failed calls still get the exception of the first call.
+func WithDuplicateAck() Option {
+	return func(c *Codec) {
+		c.duplicateAck = true
+	}
+}
+
+// WithActionConcurrency limits the number of calls a Router serves at the
+// same time per action or method. Keys are either an action name, limiting
+// all the methods of the action together, or "Action.Method". Calls over
+// the limit are rejected with an ErrBusy exception rather than queued, so
+// that a heavy action cannot tie up the server. It panics if a limit is
+// not positive.
+func WithActionConcurrency(limits map[string]int) Option {
+	for name, n := range limits {
+		if n <= 0 {
+			panic(fmt.Sprintf("rpc: concurrency limit of %s must be positive, got %d", name, n))
+		}
+	}
+	return func(c *Codec) {
+		c.semaphores = make(map[string]chan struct{}, len(limits))
+		for name, n := range limits {
+			c.semaphores[name] = make(chan struct{}, n)
+		}
+	}
+}
+
+// RewriteFunc rewrites the fields of an envelope, as decoded from its
+// encoding, for a client of the given version. It may rename, add or
+// remove fields in place. Numbers are decoded as json.Number.
+type RewriteFunc func(version string, fields map[string]interface{})
+
+// WithResponseRewrite sets a hook rewriting the envelopes written to
+// clients sending their version in the given request header, such as
+// older ExtJS versions expecting different field names. Clients without
+// the header get the standard envelopes.
+func WithResponseRewrite(header string, f RewriteFunc) Option {
+	return func(c *Codec) {
+		c.versionHeader = header
+		c.rewrite = f
+	}
+}
+
+// WithGzipLevel makes a Router compress its responses with gzip, at the
+// given compress/gzip level, for clients accepting it. gzip.BestSpeed
+// favors CPU and gzip.BestCompression the size of responses. Invalid
+// levels use gzip.DefaultCompression. All the responses of the Router then
+// carry a Vary: Accept-Encoding header, compressed or not.
+func WithGzipLevel(level int) Option {
+	if level < flate.HuffmanOnly || level > gzip.BestCompression {
+		level = gzip.DefaultCompression
+	}
+	return func(c *Codec) {
+		c.gzipLevel = &level
+	}
+}
+
+// WithMaxHeaderBytes makes a Router answer requests whose request line and
+// headers, such as large cookies or authorization headers, exceed n bytes
+// with ErrHeaderTooLarge exceptions and a 431 status.
+//
+// Requests exceeding the MaxHeaderBytes of the http.Server are rejected by
+// the server with a plain 431 response before reaching the router, so it
+// must be set above n, as the default of 1MB usually is, for clients to get
+// an exception.
+func WithMaxHeaderBytes(n int) Option {
+	return func(c *Codec) {
+		c.maxHeaderBytes = n
+	}
+}
+
+// WithResponseSigning makes a Router sign its responses with an
+// HMAC-SHA256 of the body, before compression, keyed with key. The hex
+// encoded signature is sent in the X-RPC-Signature header so that clients
+// can verify the response was not tampered with, as
+// DecodeSignedClientResponse does. Responses are buffered to be signed,
+// except those that are streamed, such as batches with WithStreamingBatch
+// and downloads: their signature is sent as a trailer of the same name,
+// as read by DecodeSignedHTTPResponse.
+func WithResponseSigning(key []byte) Option {
+	return func(c *Codec) {
+		c.signKey = key
+	}
+}
+
+// WithMaxFieldSize limits the size of each field of multipart form posts,
+// files excepted, to n bytes. The limit is enforced as the form is read and
+// posts exceeding it are answered with ErrFieldTooLarge. It complements the
+// limit on the whole body, as a single field could otherwise be huge.
+func WithMaxFieldSize(n int64) Option {
+	return func(c *Codec) {
+		c.maxFieldSize = n
+	}
+}
+
+// WithUploadLimit limits the multipart form posts, such as uploads, whose
+// body is read at the same time to n, across the server. Posts exceeding
+// the limit are rejected with ErrBusy before their body is read; a Router
+// answers them with a 503 status and the exception wrapped in HTML like
+// the responses to uploads. The limit is separate from the concurrency
+// limits of actions. Zero or less means no limit.
+func WithUploadLimit(n int) Option {
+	return func(c *Codec) {
+		c.uploadSlots = nil
+		if n > 0 {
+			c.uploadSlots = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithUploadProgress makes the codec report the progress of uploads to
+// the clients listening to UploadProgressHandler.
+func WithUploadProgress() Option {
+	return func(c *Codec) {
+		c.uploads = new(progressHub)
+	}
+}
+
+// EncodeFunc encodes an envelope, given as its compact JSON encoding.
+type EncodeFunc func(v interface{}) ([]byte, error)
+
+// PrettyEncoder is an EncodeFunc indenting envelopes for readability.
+func PrettyEncoder(v interface{}) ([]byte, error) {
+	return json.MarshalIndent(v, "", "  ")
+}
+
+// WithEncoder registers an envelope encoder that clients may request by
+// name in the X-RPC-Accept header, such as PrettyEncoder for "pretty".
+// Requests naming no registered encoder get the default compact encoding.
+func WithEncoder(name string, f EncodeFunc) Option {
+	return func(c *Codec) {
+		if c.encoders == nil {
+			c.encoders = make(map[string]EncodeFunc)
+		}
+		c.encoders[name] = f
+	}
+}
+
+// WithRecentErrors makes the codec record the last n exceptions it writes,
+// available from RecentErrors and, in debug mode, RecentErrorsHandler.
+func WithRecentErrors(n int) Option {
+	return func(c *Codec) {
+		if n > 0 {
+			c.recentErrors = &errorLog{records: make([]ErrorRecord, n)}
+		}
+	}
+}
+
+// WithFanOutLimit limits the calls a Router dispatches from batches to
+// limit per period, across all batches, to protect the services behind the
+// methods. The budget refills continuously. Batches exceeding the
+// remaining budget are rejected as a whole with ErrBusy exceptions and a
+// 503 status. Single calls are not counted. It panics if limit or per is
+// not positive.
+func WithFanOutLimit(limit int, per time.Duration) Option {
+	if limit <= 0 || per <= 0 {
+		panic(fmt.Sprintf("rpc: fan-out limit must be positive, got %d per %v", limit, per))
+	}
+	return func(c *Codec) {
+		c.fanOut = newFanOut(limit, per)
+	}
+}
+
+// WithCallTimeout makes a Router answer calls that do not complete within
+// d with an ErrTimeout exception. The context of the call is canceled so
+// that methods watching it can stop early.
+func WithCallTimeout(d time.Duration) Option {
+	return func(c *Codec) {
+		c.callTimeout = d
+	}
+}
+
+// WithClientDeadline makes a Router honor the X-RPC-Deadline-Ms header,
+// holding the number of milliseconds the client waits for its calls. The
+// deadline is capped by max and applies like the call timeout, which it can
+// only shorten: calls that miss it are answered with ErrTimeout exceptions.
+func WithClientDeadline(max time.Duration) Option {
+	return func(c *Codec) {
+		c.maxDeadline = max
+	}
+}
+
+// WithTimestampTolerance makes the codec reject requests whose
+// X-RPC-Timestamp header, the time the client sent them in seconds since
+// the Unix epoch, is more than d in the future or in the past, which tells
+// clock skew or replayed requests. A Router answers them with ErrClockSkew
+// exceptions and a 400 status. Requests without the header are accepted.
+func WithTimestampTolerance(d time.Duration) Option {
+	return func(c *Codec) {
+		c.timestampTolerance = d
+	}
+}
+
+// BatchTimeoutPolicy tells a Router how the call timeout applies to the
+// calls of a batch.
+type BatchTimeoutPolicy int
+
+const (
+	// BatchTimeoutEarly answers a call of a batch that times out with an
+	// ErrTimeout exception and proceeds with the other calls. It is the
+	// default.
+	BatchTimeoutEarly BatchTimeoutPolicy = iota
+	// BatchTimeoutWait makes the batch wait for slow calls to complete,
+	// answering them with their actual response. The call timeout then
+	// only applies to single calls.
+	BatchTimeoutWait
+)
+
+// WithBatchTimeoutPolicy sets how the call timeout set by WithCallTimeout
+// applies to the calls of a batch.
+func WithBatchTimeoutPolicy(p BatchTimeoutPolicy) Option {
+	return func(c *Codec) {
+		c.batchTimeout = p
+	}
+}
+
+// WithPartialHeader makes a Router set the "X-RPC-Partial: true" response
+// header when some calls of a batch timed out, telling clients which
+// responses to retry: the body still holds a timeout exception for each of
+// them.
+func WithPartialHeader() Option {
+	return func(c *Codec) {
+		c.partialHeader = true
+	}
+}
+
+// WithStreamingBatch makes a Router write the envelopes of a batch as the
+// calls complete, flushing each one, so that clients reading the response
+// as a stream can process the first results early. The calls are still
+// served in order and the body is still a JSON array. Over HTTP/1.1 the
+// response, flushed without a length, uses chunked transfer.
+//
+// As the header is sent with the first envelope, the status is always 200
+// and the X-RPC-Partial header of WithPartialHeader is sent as a trailer,
+// as is the signature of WithResponseSigning.
+func WithStreamingBatch() Option {
+	return func(c *Codec) {
+		c.streamBatch = true
+	}
+}
+
+// WithPartialReply makes method exceptions carry the reply under "data"
+// when the method set it before returning an error, so that clients get
+// the partial results. By default the reply of a failed call is discarded.
+func WithPartialReply() Option {
+	return func(c *Codec) {
+		c.partialReply = true
+	}
+}
+
+// WithRedirectHeader makes the codec also set the X-RPC-Redirect response
+// header to the URL of Redirect results, for clients and proxies handling
+// navigation outside of the envelope.
+func WithRedirectHeader() Option {
+	return func(c *Codec) {
+		c.redirectHeader = true
+	}
+}
+
+// WithStrictPaths makes Router.Mount serve each endpoint at its path
+// without a trailing slash only. By default base/router/ is served like
+// base/router, and so are the other endpoints.
+func WithStrictPaths() Option {
+	return func(c *Codec) {
+		c.strictPaths = true
+	}
+}
+
+// WithPoll sets the function serving the events of the poll endpoint that
+// Router.Mount registers next to the router.
+func WithPoll(f PollFunc) Option {
+	return func(c *Codec) {
+		c.poll = f
+	}
+}
+
+// CryptoFunc transforms a JSON value for WithCrypto.
+type CryptoFunc func(b []byte) ([]byte, error)
+
+// WithCrypto sets hooks protecting sensitive payloads. decrypt receives the
+// raw JSON data of each request and returns the JSON the arguments are
+// decoded from. encrypt receives each encoded result and returns the JSON
+// value sent as result, such as a string holding the base64 ciphertext.
+// Either hook may be nil. A failing decrypt rejects the request and a
+// failing encrypt turns the result into an exception.
+func WithCrypto(decrypt, encrypt CryptoFunc) Option {
+	return func(c *Codec) {
+		c.decrypt = decrypt
+		c.encrypt = encrypt
+	}
+}
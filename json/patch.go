@@ -0,0 +1,87 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"encoding/json"
+)
+
+// PatchResult is a method reply holding an RFC 6902 JSON Patch, for
+// clients updating a view incrementally instead of reloading it.
+//
+// It is encoded under "result" as an object with a "patch" marker set to
+// true and the operations under "ops":
+//
+//	{"patch":true,"ops":[{"op":"replace","path":"/rows/0/qty","value":3}]}
+//
+// A method returns a patch by using *PatchResult as its reply type and
+// adding operations with its helper methods.
+type PatchResult struct {
+	Ops []PatchOp
+}
+
+// PatchOp is a single JSON Patch operation.
+type PatchOp struct {
+	// Op is the operation: "add", "remove", "replace", "move", "copy" or
+	// "test".
+	Op string
+	// Path is the JSON Pointer of the target location.
+	Path string
+	// From is the source location of "move" and "copy" operations.
+	From string
+	// Value is the value of "add", "replace" and "test" operations.
+	Value interface{}
+}
+
+// MarshalJSON encodes the operation, writing only the members it uses.
+func (o PatchOp) MarshalJSON() ([]byte, error) {
+	fields := map[string]interface{}{
+		"op":   o.Op,
+		"path": o.Path,
+	}
+	switch o.Op {
+	case "move", "copy":
+		fields["from"] = o.From
+	case "add", "replace", "test":
+		fields["value"] = o.Value
+	}
+	return json.Marshal(fields)
+}
+
+// MarshalJSON encodes the patch with its marker.
+func (p PatchResult) MarshalJSON() ([]byte, error) {
+	ops := p.Ops
+	if ops == nil {
+		ops = []PatchOp{}
+	}
+	return json.Marshal(map[string]interface{}{
+		"patch": true,
+		"ops":   ops,
+	})
+}
+
+// Add appends an "add" operation setting value at path.
+func (p *PatchResult) Add(path string, value interface{}) *PatchResult {
+	p.Ops = append(p.Ops, PatchOp{Op: "add", Path: path, Value: value})
+	return p
+}
+
+// Remove appends a "remove" operation deleting the value at path.
+func (p *PatchResult) Remove(path string) *PatchResult {
+	p.Ops = append(p.Ops, PatchOp{Op: "remove", Path: path})
+	return p
+}
+
+// Replace appends a "replace" operation replacing the value at path.
+func (p *PatchResult) Replace(path string, value interface{}) *PatchResult {
+	p.Ops = append(p.Ops, PatchOp{Op: "replace", Path: path, Value: value})
+	return p
+}
+
+// Move appends a "move" operation moving the value at from to path.
+func (p *PatchResult) Move(from, path string) *PatchResult {
+	p.Ops = append(p.Ops, PatchOp{Op: "move", From: from, Path: path})
+	return p
+}
@@ -0,0 +1,86 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ----------------------------------------------------------------------------
+// Polling
+// ----------------------------------------------------------------------------
+
+// Event is an event pushed to ExtDirect polling providers.
+//
+// A remoting method can also answer with an event by using *Event as its
+// reply type, for clients handling pushes on responses. The envelope then
+// has type "event" and carries the name and data of the event instead of
+// a result, with the tid, action and method of the call so that the client
+// completes the call too:
+//
+//	{"type":"event","name":"stock","data":{"qty":3},"tid":4,"action":"Shop","method":"Buy"}
+//
+// Ext JS providers fire the event and pass it to the callback of the call
+// in place of the result. A reply without a name is encoded as a result.
+type Event struct {
+	// Name is the event name the client listens to.
+	Name string
+	// Data is the event payload.
+	Data interface{}
+}
+
+// MarshalJSON encodes the event as an ExtDirect event envelope.
+func (e Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"type": "event",
+		"name": e.Name,
+		"data": e.Data,
+	})
+}
+
+// PollFunc returns the events to deliver to a polling client. Returning no
+// events is not an error.
+type PollFunc func(r *http.Request) ([]Event, error)
+
+// NewPollHandler returns a PollHandler serving the events returned by f.
+func NewPollHandler(c *Codec, f PollFunc) *PollHandler {
+	return &PollHandler{codec: c, poll: f}
+}
+
+// PollHandler is the http.Handler serving an ExtDirect polling endpoint.
+//
+// Each poll is answered with a JSON array of event envelopes, which is
+// empty when there are no events. The envelopes are encoded like those
+// answering calls, with the finalizer, schema version and other envelope
+// options of the codec. If polling fails an exception envelope
+// is written instead. With WithTokenAuth, polls are authenticated like
+// calls, so that the poll function finds the principal, and rejected with
+// a 401 status when authentication fails.
+type PollHandler struct {
+	codec *Codec
+	poll  PollFunc
+}
+
+// ServeHTTP implements http.Handler.
+func (h *PollHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.codec.setServedBy(w)
+	// Authenticate the poll so that the poll function finds the principal.
+	if err := h.codec.authorize(r); err != nil {
+		h.codec.writeEnvelope(w, http.StatusUnauthorized, exception(&serverRequest{}, err))
+		return
+	}
+	events, err := h.poll(r)
+	if err != nil {
+		h.codec.writeEnvelope(w, http.StatusOK, exception(&serverRequest{}, err))
+		return
+	}
+	envs := make([][]byte, len(events))
+	for i, e := range events {
+		envs[i] = h.codec.encodeEnvelope(&Envelope{Type: "event", Name: e.Name, Data: e.Data, pushed: true})
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(append(joinEnvelopes(envs), '\n'))
+}
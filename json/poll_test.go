@@ -0,0 +1,171 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func poll(t *testing.T, h http.Handler) []map[string]interface{} {
+	r, _ := http.NewRequest("GET", "http://localhost:8080/poll", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	var events []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &events); err != nil {
+		t.Fatalf("Expected an array of events, but got %q: %v", w.Body.String(), err)
+	}
+	return events
+}
+
+func TestPollMultipleEvents(t *testing.T) {
+	h := NewPollHandler(NewCodec(), func(r *http.Request) ([]Event, error) {
+		return []Event{{"message", "hello"}, {"message", "world"}}, nil
+	})
+	events := poll(t, h)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, but got %v", events)
+	}
+	for i, data := range []string{"hello", "world"} {
+		if e := events[i]; e["type"] != "event" || e["name"] != "message" || e["data"] != data {
+			t.Errorf("Expected event %q, but got %v", data, e)
+		}
+	}
+}
+
+func TestPollNoEvents(t *testing.T) {
+	h := NewPollHandler(NewCodec(), func(r *http.Request) ([]Event, error) {
+		return nil, nil
+	})
+	if events := poll(t, h); len(events) != 0 {
+		t.Errorf("Expected no events, but got %v", events)
+	}
+}
+
+func TestPollError(t *testing.T) {
+	h := NewPollHandler(NewCodec(), func(r *http.Request) ([]Event, error) {
+		return nil, errors.New("poll failed")
+	})
+	r, _ := http.NewRequest("GET", "http://localhost:8080/poll", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	var env map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &env)
+	if env["type"] != "exception" || env["message"] != "poll failed" {
+		t.Errorf("Expected exception envelope, but got %v", env)
+	}
+}
+
+type Builds struct {
+	tasks *Tasks
+	run   chan ProgressToken
+}
+
+func (s *Builds) Start(r *http.Request, req *struct{}, res *ProgressToken) error {
+	*res = s.tasks.Start(r)
+	s.run <- *res
+	return nil
+}
+
+func TestTasks(t *testing.T) {
+	tasks := NewTasks(time.Minute)
+	builds := &Builds{tasks: tasks, run: make(chan ProgressToken, 1)}
+	c := NewCodec(WithPoll(tasks.Poll), WithTokenAuth(func(token string) (Principal, error) {
+		return token, nil
+	}))
+	mux := http.NewServeMux()
+	newRouter(c, builds).Mount(mux, "/direct", "")
+
+	r := newRequest(`{"action":"Builds","method":"Start","type":"rpc","tid":1,"data":null}`)
+	r.URL.Path = "/direct/router"
+	r.Header.Set("Authorization", "Bearer alice")
+	_, env := route(mux, r)
+	result, _ := env["result"].(map[string]interface{})
+	token, _ := result["progressToken"].(string)
+	if token == "" || ProgressToken(token) != <-builds.run {
+		t.Fatalf("Expected a progress token, but got %v", env)
+	}
+
+	pollTask := func(principal string) []map[string]interface{} {
+		r, _ := http.NewRequest("GET", "http://localhost:8080/direct/poll?progressToken="+token, nil)
+		r.Header.Set("Authorization", "Bearer "+principal)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		var events []map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &events)
+		return events
+	}
+	if events := pollTask("alice"); len(events) != 0 {
+		t.Errorf("Expected no event for a pending task, but got %v", events)
+	}
+
+	if !tasks.Complete(ProgressToken(token), 42, nil) || tasks.Complete(ProgressToken(token), 43, nil) {
+		t.Errorf("Expected the task to complete once")
+	}
+	if events := pollTask("bob"); len(events) != 0 {
+		t.Errorf("Expected no event for another principal, but got %v", events)
+	}
+	events := pollTask("alice")
+	if len(events) != 1 || events[0]["name"] != "complete" {
+		t.Fatalf("Expected the completion event, but got %v", events)
+	}
+	if data := events[0]["data"].(map[string]interface{}); data["progressToken"] != token || data["result"] != float64(42) {
+		t.Errorf("Expected the task result, but got %v", data)
+	}
+	if events := pollTask("alice"); len(events) != 0 {
+		t.Errorf("Expected the completion to be delivered once, but got %v", events)
+	}
+
+	r = r.WithContext(withPrincipal(r.Context(), "alice"))
+	token = string(tasks.Start(r))
+	tasks.Complete(ProgressToken(token), nil, errors.New("report failed"))
+	if events := pollTask("alice"); len(events) != 1 || events[0]["data"].(map[string]interface{})["message"] != "report failed" {
+		t.Errorf("Expected the task error, but got %v", events)
+	}
+}
+
+func TestTasksExpire(t *testing.T) {
+	tasks := NewTasks(10 * time.Millisecond)
+	r, _ := http.NewRequest("GET", "http://localhost:8080/poll", nil)
+	pending, completed := tasks.Start(r), tasks.Start(r)
+	tasks.Complete(completed, 1, nil)
+	time.Sleep(20 * time.Millisecond)
+	if tasks.Complete(pending, 1, nil) {
+		t.Error("Expected the pending task to expire")
+	}
+	r, _ = http.NewRequest("GET", "http://localhost:8080/poll?progressToken="+string(completed), nil)
+	if events, _ := tasks.Poll(r); len(events) != 0 {
+		t.Errorf("Expected the undelivered completion to expire, but got %v", events)
+	}
+	if n := len(tasks.tasks); n != 0 {
+		t.Errorf("Expected the expired tasks to be forgotten, but %d remain", n)
+	}
+}
+
+func TestPollEnvelopeOptions(t *testing.T) {
+	c := NewCodec(WithSchemaVersion("2"), WithOmitEmpty(), WithEnvelopeFinalizer(func(env *Envelope) {
+		env.Extra = map[string]interface{}{"node": "a"}
+	}))
+	h := NewPollHandler(c, func(r *http.Request) ([]Event, error) {
+		return []Event{{"message", nil}}, nil
+	})
+	events := poll(t, h)
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, but got %v", events)
+	}
+	e := events[0]
+	if e["type"] != "event" || e["name"] != "message" || e["schemaVersion"] != "2" || e["node"] != "a" {
+		t.Errorf("Expected the envelope options to apply, but got %v", e)
+	}
+	for _, k := range []string{"data", "tid", "action", "method"} {
+		if _, ok := e[k]; ok {
+			t.Errorf("Expected no %s, but got %v", k, e)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// uploadIDHeader is the request header identifying an upload whose
+// progress is reported. Uploads posted through a hidden iframe, which
+// cannot set headers, pass the "uploadId" query parameter instead.
+const uploadIDHeader = "X-Upload-Id"
+
+// Progress reports how much of an upload body was read.
+type Progress struct {
+	// Read is the number of bytes read.
+	Read int64 `json:"read"`
+	// Total is the declared length of the body, or -1 if unknown.
+	Total int64 `json:"total"`
+}
+
+// progressHub dispatches the progress of uploads to their subscribers.
+type progressHub struct {
+	mu   sync.Mutex
+	subs map[string][]chan Progress
+}
+
+// subscribe returns a channel receiving the progress of the upload id. The
+// channel is closed once the upload body was read. cancel unsubscribes.
+func (h *progressHub) subscribe(id string) (ch chan Progress, cancel func()) {
+	ch = make(chan Progress, 64)
+	h.mu.Lock()
+	if h.subs == nil {
+		h.subs = make(map[string][]chan Progress)
+	}
+	h.subs[id] = append(h.subs[id], ch)
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		subs := h.subs[id]
+		for i, sub := range subs {
+			if sub == ch {
+				h.subs[id] = append(subs[:i:i], subs[i+1:]...)
+				close(ch)
+				break
+			}
+		}
+		if len(h.subs[id]) == 0 {
+			delete(h.subs, id)
+		}
+	}
+}
+
+// publish sends p to the subscribers of the upload id. Subscribers lagging
+// behind miss intermediate updates.
+func (h *progressHub) publish(id string, p Progress, final bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, ch := range h.subs[id] {
+		if final {
+			// Make room for the final update, which must not be missed.
+			select {
+			case <-ch:
+			default:
+			}
+		}
+		select {
+		case ch <- p:
+		default:
+		}
+		if final {
+			close(ch)
+		}
+	}
+	if final {
+		delete(h.subs, id)
+	}
+}
+
+// progressReader is an upload body publishing its progress as it is read.
+type progressReader struct {
+	io.ReadCloser
+	hub      *progressHub
+	id       string
+	progress Progress
+}
+
+// Read implements io.Reader.
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.progress.Read += int64(n)
+		r.hub.publish(r.id, r.progress, false)
+	}
+	return n, err
+}
+
+// trackUpload makes the body of the form post r report its progress, if
+// the codec uses WithUploadProgress and r carries an upload id. The
+// returned function must be called once the body was read.
+func (c *Codec) trackUpload(r *http.Request) (done func()) {
+	if c.uploads == nil || !isForm(r) {
+		return func() {}
+	}
+	id := r.Header.Get(uploadIDHeader)
+	if id == "" {
+		id = r.URL.Query().Get("uploadId")
+	}
+	if id == "" {
+		return func() {}
+	}
+	pr := &progressReader{
+		ReadCloser: r.Body,
+		hub:        c.uploads,
+		id:         id,
+		progress:   Progress{Total: r.ContentLength},
+	}
+	r.Body = pr
+	return func() {
+		c.uploads.publish(id, pr.progress, true)
+	}
+}
+
+// UploadProgressHandler returns a handler streaming the progress of an
+// upload as server-sent events, if the codec uses WithUploadProgress. The
+// upload is identified by the "id" query parameter.
+//
+// The client opens the stream before posting the upload with the same id in
+// the X-Upload-Id header or the "uploadId" query parameter. Each update is
+// a "progress" event with {"read":n,"total":n} as data; the stream ends
+// with a "done" event once the body was read.
+func (c *Codec) UploadProgressHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		flusher, ok := w.(http.Flusher)
+		if c.uploads == nil || id == "" || !ok {
+			http.Error(w, "rpc: upload progress not available", http.StatusBadRequest)
+			return
+		}
+		ch, cancel := c.uploads.subscribe(id)
+		defer cancel()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		// A comment tells the client the stream is ready.
+		io.WriteString(w, ": subscribed\n\n")
+		flusher.Flush()
+		var last Progress
+		for {
+			select {
+			case p, ok := <-ch:
+				if !ok {
+					b, _ := json.Marshal(last)
+					fmt.Fprintf(w, "event: done\ndata: %s\n\n", b)
+					flusher.Flush()
+					return
+				}
+				if p == last {
+					// The final update repeats the last one.
+					continue
+				}
+				last = p
+				b, _ := json.Marshal(p)
+				fmt.Fprintf(w, "event: progress\ndata: %s\n\n", b)
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,27 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"encoding/json"
+)
+
+// redirectHeader is the response header set to the target of a Redirect
+// result, if the codec uses WithRedirectHeader.
+const redirectHeader = "X-RPC-Redirect"
+
+// Redirect is a method reply telling the client to navigate to URL, for
+// navigation flows driven by the server. It is encoded under "result" as
+// {"redirect":"<url>"}.
+//
+// A method redirects by using *Redirect as its reply type and setting URL.
+type Redirect struct {
+	URL string
+}
+
+// MarshalJSON encodes the redirect.
+func (r Redirect) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{"redirect": r.URL})
+}
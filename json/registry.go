@@ -0,0 +1,311 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/rpc"
+)
+
+// ----------------------------------------------------------------------------
+// Registry
+// ----------------------------------------------------------------------------
+
+// NewRegistry returns a new, empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		methods: make(map[string]*Method),
+		folded:  make(map[string]*Method),
+		served:  make(map[string]bool),
+	}
+}
+
+// Registry holds the settings of the ExtDirect methods served by a codec.
+//
+// Methods are identified by action and method name, as sent by the client.
+// Methods that were not added use the codec defaults.
+type Registry struct {
+	mu      sync.RWMutex
+	methods map[string]*Method
+	// folded indexes methods by lower case name for case-insensitive
+	// lookups.
+	folded map[string]*Method
+	// streams caches whether a method is marked Stream, once known.
+	streams, streamsKnown bool
+	// served holds the methods registered with an rpc server through
+	// RegisterService.
+	served map[string]bool
+}
+
+// Method holds the settings of a single remoting method.
+//
+// Fields should be set before the codec starts serving requests.
+type Method struct {
+	// The action (service) name.
+	Action string
+	// The method name.
+	Name string
+	// CSV allows the reply to be exported as text/csv when the request asks
+	// for it. The reply must implement CSVExporter.
+	CSV bool
+	// SLA is the expected maximum duration of a call. Slower calls are
+	// logged as warnings and counted in Stats.SLAViolations. Zero disables
+	// the check.
+	SLA time.Duration
+	// SliceArg makes the whole data array decode into the method argument,
+	// which must be a slice, instead of its first element. It is meant for
+	// methods taking a single []T argument.
+	SliceArg bool
+	// UploadTypes lists the media types allowed for files uploaded to the
+	// method, such as "image/png" or "image/*". Types are sniffed from the
+	// file contents. Empty allows any type.
+	UploadTypes []string
+	// Read classifies the method as a read, without side effects. Only
+	// reads may be called with GET, answered with 304 Not Modified or
+	// coalesced. Methods are writes by default, as are methods missing
+	// from the registry.
+	Read bool
+	// Coalesce makes a Router share the response of a call in flight with
+	// the identical calls, from the same principal with the same data,
+	// made before it completes, so that only one of them is dispatched. It
+	// only applies to Read methods, called by authenticated principals.
+	Coalesce bool
+	// MaxDataSize is the maximum size in bytes of the encoded data of a
+	// call, checked before its arguments are decoded. Larger calls are
+	// answered with ErrDataTooLarge. Zero means no limit.
+	MaxDataSize int
+	// EmptyResult makes the method answer with an empty object result
+	// instead of null when its reply is nil, for clients expecting
+	// "result":{} from acknowledgement-only methods.
+	EmptyResult bool
+	// Stream makes the codec decode the array sent as the argument of the
+	// method element by element, as the method reads them from its
+	// *ParamStream argument, so that huge arrays are not decoded at once.
+	// The action and method must be sent before the data, as must the tid
+	// when the codec checks tids, and MaxDataSize is checked as elements
+	// are read. Stream methods cannot be called with WithCrypto. A Router
+	// still buffers the request body.
+	Stream bool
+	// Defaults holds default values of the fields of the argument object,
+	// by JSON name. They are decoded into the argument before the data of
+	// the call, so that the fields sent by the client win. They do not
+	// apply to SliceArg methods.
+	Defaults map[string]interface{}
+	// Len is the number of arguments the method takes, as published in the
+	// API descriptor. Add sets it to 1.
+	Len int
+	// FormHandler marks the method as a form handler in the API
+	// descriptor, so that clients submit forms and uploads to it.
+	FormHandler bool
+}
+
+// Add adds the method action.name to the registry and returns its
+// settings. Adding the same method again returns the existing settings.
+func (r *Registry) Add(action, name string) *Method {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := action + "." + name
+	if m, ok := r.methods[key]; ok {
+		return m
+	}
+	m := &Method{Action: action, Name: name, Len: 1}
+	r.methods[key] = m
+	r.folded[strings.ToLower(key)] = m
+	r.streamsKnown = false
+	return m
+}
+
+// Lookup returns the settings of the method action.name, or nil if it was
+// not added.
+func (r *Registry) Lookup(action, name string) *Method {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.methods[action+"."+name]
+}
+
+// lookupFold is like Lookup but matches action and name case-insensitively.
+func (r *Registry) lookupFold(action, name string) *Method {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.folded[strings.ToLower(action+"."+name)]
+}
+
+// Methods returns the settings of all methods in the registry, sorted by
+// action and method name.
+func (r *Registry) Methods() []*Method {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	methods := make([]*Method, 0, len(r.methods))
+	for _, m := range r.methods {
+		methods = append(methods, m)
+	}
+	r.mu.RUnlock()
+	sort.Sort(byName(methods))
+	return methods
+}
+
+// hasStreams reports whether a method of the registry is marked Stream.
+// The answer is cached until a method is added, as the settings of the
+// methods are set before the codec serves requests.
+func (r *Registry) hasStreams() bool {
+	if r == nil {
+		return false
+	}
+	r.mu.RLock()
+	streams, known := r.streams, r.streamsKnown
+	r.mu.RUnlock()
+	if known {
+		return streams
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.streams = false
+	for _, m := range r.methods {
+		if m.Stream {
+			r.streams = true
+			break
+		}
+	}
+	r.streamsKnown = true
+	return r.streams
+}
+
+// byName sorts methods by action and method name.
+type byName []*Method
+
+func (s byName) Len() int      { return len(s) }
+func (s byName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byName) Less(i, j int) bool {
+	if s[i].Action != s[j].Action {
+		return s[i].Action < s[j].Action
+	}
+	return s[i].Name < s[j].Name
+}
+
+var (
+	typeOfRequest = reflect.TypeOf((*http.Request)(nil))
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// isServable reports whether the method type t, receiver included, has the
+// signature of the methods served by the rpc server.
+func isServable(t reflect.Type) bool {
+	return t.NumIn() == 4 && t.In(1) == typeOfRequest && t.In(3).Kind() == reflect.Ptr &&
+		t.NumOut() == 1 && t.Out(0) == typeOfError
+}
+
+// signature returns the signature of the method type t, without its
+// receiver.
+func signature(t reflect.Type) string {
+	in := make([]reflect.Type, 0, t.NumIn())
+	for i := 1; i < t.NumIn(); i++ {
+		in = append(in, t.In(i))
+	}
+	out := make([]reflect.Type, t.NumOut())
+	for i := range out {
+		out[i] = t.Out(i)
+	}
+	return reflect.FuncOf(in, out, t.IsVariadic()).String()
+}
+
+// RegisterService registers receiver with s like rpc.Server.RegisterService,
+// after checking the methods of the registry for its action against the Go
+// methods of receiver. It returns an error, without registering receiver,
+// if a method does not exist, does not have the signature of rpc methods,
+// or takes a number of arguments other than its declared Len: methods take a single argument, or none when it is an
+// empty struct, unless they are SliceArg methods taking a slice of any
+// length. The methods registered are remembered for Router.Verify.
+func (r *Registry) RegisterService(s *rpc.Server, receiver interface{}, name string) error {
+	rcvr := reflect.TypeOf(receiver)
+	if name == "" {
+		name = reflect.Indirect(reflect.ValueOf(receiver)).Type().Name()
+	}
+	for _, m := range r.Methods() {
+		if m.Action != name {
+			continue
+		}
+		method, ok := rcvr.MethodByName(m.Name)
+		if !ok {
+			return fmt.Errorf("rpc: %s.%s is in the registry but not a method of %s", name, m.Name, rcvr)
+		}
+		if !isServable(method.Type) {
+			return fmt.Errorf("rpc: %s.%s is in the registry but has signature %s, want func(*http.Request, *Args, *Reply) error",
+				name, m.Name, signature(method.Type))
+		}
+		if err := m.checkArgs(method.Type.In(2)); err != nil {
+			return err
+		}
+	}
+	if err := s.RegisterService(receiver, name); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := 0; i < rcvr.NumMethod(); i++ {
+		if method := rcvr.Method(i); s.HasMethod(name + "." + method.Name) {
+			r.served[name+"."+method.Name] = true
+		}
+	}
+	return nil
+}
+
+// servedMethods returns the names of the methods registered with an rpc
+// server through RegisterService, sorted.
+func (r *Registry) servedMethods() []string {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	names := make([]string, 0, len(r.served))
+	for name := range r.served {
+		names = append(names, name)
+	}
+	r.mu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// checkArgs returns an error if the declared Len of m does not match its
+// Go argument type.
+func (m *Method) checkArgs(args reflect.Type) error {
+	if args.Kind() != reflect.Ptr {
+		return fmt.Errorf("rpc: %s.%s: argument must be a pointer, got %s", m.Action, m.Name, args)
+	}
+	args = args.Elem()
+	switch {
+	case m.Stream:
+		if args != reflect.TypeOf(ParamStream{}) {
+			return fmt.Errorf("rpc: %s.%s is a Stream method but takes %s", m.Action, m.Name, args)
+		}
+		return nil
+	case m.SliceArg:
+		if args.Kind() != reflect.Slice {
+			return fmt.Errorf("rpc: %s.%s is a SliceArg method but takes %s", m.Action, m.Name, args)
+		}
+		return nil
+	case m.Len == 1 || m.Len == 0 && args.Kind() == reflect.Struct && args.NumField() == 0:
+		return nil
+	}
+	n := 1
+	if args.Kind() == reflect.Struct && args.NumField() == 0 {
+		n = 0
+	}
+	return fmt.Errorf("rpc: %s.%s declares len %d but takes %d argument(s)", m.Action, m.Name, m.Len, n)
+}
@@ -0,0 +1,73 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// requestIDHeader is the header carrying the request id, set by upstream
+// gateways and echoed with WithRequestID.
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLen is the maximum length of an inbound request id. Longer
+// ids are replaced with generated ones.
+const maxRequestIDLen = 128
+
+type requestIDKey struct{}
+
+// RequestIDFromContext returns the request id of the call, if the codec
+// uses WithRequestID.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok
+}
+
+// withRequestID returns the context of r holding its request id, and the
+// id. The id already in the context is kept, so that the calls of a batch
+// share the id assigned by the Router. Otherwise the inbound X-Request-Id
+// header is used, or a new id is generated if it is absent or invalid.
+func withRequestID(r *http.Request) (context.Context, string) {
+	ctx := r.Context()
+	if id, ok := RequestIDFromContext(ctx); ok {
+		return ctx, id
+	}
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	return context.WithValue(ctx, requestIDKey{}, id), id
+}
+
+// validRequestID reports whether an inbound request id can be reused: it
+// must be non-empty, not too long and made of printable ASCII characters.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random request id.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// echoRequestID sets the request id header of w if the codec echoes ids.
+func (c *Codec) echoRequestID(w http.ResponseWriter, id string) {
+	if c.echoID && id != "" {
+		w.Header().Set(requestIDHeader, id)
+	}
+}
@@ -0,0 +1,609 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/rpc"
+)
+
+// batchHeader is the request header a client may set to declare whether
+// the body holds a batch ("true") or a single call ("false").
+const batchHeader = "X-RPC-Batch"
+
+// acceptHeader is the request header naming the encoder a client wants
+// its envelopes encoded with, among those set with WithEncoder.
+const acceptHeader = "X-RPC-Accept"
+
+// partialHeader is the response header set to "true" when some calls of a
+// batch timed out, if the codec uses WithPartialHeader.
+const partialHeader = "X-RPC-Partial"
+
+// deadlineHeader is the request header a client may set to the number of
+// milliseconds it waits for its calls, if the codec uses
+// WithClientDeadline.
+const deadlineHeader = "X-RPC-Deadline-Ms"
+
+// ErrEmptyBatch is returned for requests holding an empty batch, unless
+// the codec allows them with WithRejectEmptyBatch(false).
+var ErrEmptyBatch = errors.New("rpc: request ill-formed: empty batch")
+
+// ErrShapeMismatch is returned in strict shape mode when the batch header
+// of a request does not match its body.
+var ErrShapeMismatch = errors.New("rpc: request ill-formed: " + batchHeader + " header does not match the body")
+
+// ----------------------------------------------------------------------------
+// Router
+// ----------------------------------------------------------------------------
+
+// NewRouter returns a Router dispatching requests through s.
+//
+// The codec must be the one registered with s. The router applies the
+// codec checks that have to answer before a call is dispatched and writes
+// their failures as ExtDirect exceptions.
+func NewRouter(s *rpc.Server, c *Codec) *Router {
+	return &Router{server: s, codec: c}
+}
+
+// Router is the http.Handler serving the ExtDirect remoting endpoint.
+//
+// A request body holds either a single call or a batch: a JSON array of
+// calls, answered with a JSON array of envelopes in the same order.
+// Notifications in a batch have no envelope. The body decides the shape of
+// the request: an X-RPC-Batch header that does not match the body is
+// ignored, unless the codec uses WithStrictShape.
+//
+// Methods classified as reads in the registry can also be called with GET,
+// the call being described by the action, method, tid and data query
+// parameters. GET requests calling other methods are answered with
+// ErrWriteMethod exceptions and a 405 status.
+//
+// A method that panics is answered with an "rpc: internal error" exception
+// and a 500 status, and the panic is logged.
+type Router struct {
+	server *rpc.Server
+	codec  *Codec
+	// paused is set to 1 when the router does not accept new calls. It is
+	// accessed atomically.
+	paused int32
+
+	mu sync.Mutex
+	// reported holds the methods found missing from the rpc server.
+	reported map[string]bool
+}
+
+// SetAccepting sets whether the router accepts new calls. While it does
+// not, requests are answered with ErrMaintenance exceptions and a 503
+// status. Calls already being served are not affected.
+func (rt *Router) SetAccepting(accepting bool) {
+	var paused int32
+	if !accepting {
+		paused = 1
+	}
+	atomic.StoreInt32(&rt.paused, paused)
+}
+
+// Verify checks that the codec registry and the rpc server agree, returning
+// an error describing the methods of the registry that are not registered
+// with the server, and the methods registered through
+// Registry.RegisterService that are not in the registry, and so missing
+// from the API descriptor. Methods missing from the server are otherwise
+// reported when first called.
+func (rt *Router) Verify() error {
+	reg := rt.codec.registry
+	var missing, unlisted []string
+	for _, m := range reg.Methods() {
+		if !rt.server.HasMethod(m.Action + "." + m.Name) {
+			missing = append(missing, m.Action+"."+m.Name)
+		}
+	}
+	for _, name := range reg.servedMethods() {
+		parts := strings.SplitN(name, ".", 2)
+		if reg.Lookup(parts[0], parts[1]) == nil {
+			unlisted = append(unlisted, name)
+		}
+	}
+	var problems []string
+	if len(missing) > 0 {
+		problems = append(problems, "methods in the ExtDirect registry but not registered with the rpc server: "+
+			strings.Join(missing, ", "))
+	}
+	if len(unlisted) > 0 {
+		problems = append(problems, "methods registered with the rpc server but not in the ExtDirect registry: "+
+			strings.Join(unlisted, ", "))
+	}
+	if len(problems) > 0 {
+		return errors.New("rpc: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkServed returns an error if action.method is in the registry but not
+// registered with the rpc server, logging the inconsistency the first time
+// it is found.
+func (rt *Router) checkServed(action, method string) error {
+	m := rt.codec.lookup(action, method)
+	if m == nil || rt.server.HasMethod(m.Action+"."+m.Name) {
+		return nil
+	}
+	name := m.Action + "." + m.Name
+	rt.mu.Lock()
+	if rt.reported == nil {
+		rt.reported = make(map[string]bool)
+	}
+	first := !rt.reported[name]
+	rt.reported[name] = true
+	rt.mu.Unlock()
+	if first {
+		rt.codec.logf("rpc: %s is in the ExtDirect registry but not registered with the rpc server", name)
+	}
+	return fmt.Errorf("rpc: method %s is not served", name)
+}
+
+// call is a single call of a request body.
+type call struct {
+	req  *serverRequest
+	body []byte
+}
+
+// ServeHTTP implements http.Handler.
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rt.codec.gzipLevel != nil {
+		// The response depends on Accept-Encoding even when not compressed,
+		// so that caches do not serve it to clients asking otherwise.
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			gw := &gzipResponseWriter{ResponseWriter: w, level: *rt.codec.gzipLevel}
+			defer gw.close()
+			w = gw
+		}
+	}
+	if rt.codec.signKey != nil {
+		// The signature covers the uncompressed body.
+		sw := &signingResponseWriter{ResponseWriter: w, key: rt.codec.signKey}
+		defer sw.close()
+		w = sw
+	}
+	rt.codec.setServedBy(w)
+	if rt.codec.requestIDs {
+		ctx, id := withRequestID(r)
+		r = r.WithContext(ctx)
+		rt.codec.echoRequestID(w, id)
+	}
+	release, ok := rt.codec.acquireUpload(r)
+	if !ok {
+		// The body is not read, so the call is not known. Only multipart
+		// posts are limited, which ExtDirect clients send for uploads,
+		// reading the response from an iframe.
+		env := exception(new(serverRequest), ErrBusy)
+		writeUploadEnvelope(w, http.StatusServiceUnavailable, rt.codec.encodeEnvelope(env))
+		return
+	}
+	done := rt.codec.trackUpload(r)
+	limited := rt.codec.limitFields(r)
+	calls, batch, ok, err := readCalls(r)
+	if limited() {
+		err = ErrFieldTooLarge
+	}
+	done()
+	release()
+	for _, c := range calls {
+		if rt.codec.qualifiedMethods {
+			splitMethod(c.req)
+		}
+		rt.codec.readHeaders(r, c.req)
+	}
+	if atomic.LoadInt32(&rt.paused) != 0 {
+		rt.codec.reject(w, calls, batch, http.StatusServiceUnavailable, ErrMaintenance)
+		return
+	}
+	if rt.codec.maxHeaderBytes > 0 && headerSize(r) > rt.codec.maxHeaderBytes {
+		rt.codec.reject(w, calls, batch, http.StatusRequestHeaderFieldsTooLarge, ErrHeaderTooLarge)
+		return
+	}
+	if r.Method == "GET" && !rt.codec.isRead(calls[0].req.Action, calls[0].req.Method) {
+		w.Header().Set("Allow", "POST")
+		rt.codec.reject(w, calls, batch, http.StatusMethodNotAllowed, ErrWriteMethod)
+		return
+	}
+	if err == ErrFieldTooLarge {
+		rt.codec.reject(w, calls, batch, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	if rt.codec.strictLength && err == ErrContentLength {
+		rt.codec.reject(w, calls, batch, http.StatusBadRequest, ErrContentLength)
+		return
+	}
+	if batch && len(calls) == 0 && !rt.codec.allowEmptyBatch {
+		rt.codec.writeEnvelope(w, http.StatusBadRequest, exception(new(serverRequest), ErrEmptyBatch))
+		return
+	}
+	if err := rt.codec.checkTimestamp(r); err != nil {
+		rt.codec.reject(w, calls, batch, http.StatusBadRequest, err)
+		return
+	}
+	if rt.codec.tokenAuth != nil {
+		p, err := rt.codec.authenticate(r)
+		if err != nil {
+			rt.codec.reject(w, calls, batch, http.StatusUnauthorized, err)
+			return
+		}
+		r = r.WithContext(withPrincipal(r.Context(), p))
+	}
+	if ok && rt.codec.strictShape && !matchesShape(r, batch) {
+		rt.codec.reject(w, calls, batch, http.StatusBadRequest, ErrShapeMismatch)
+		return
+	}
+	if batch && rt.codec.fanOut != nil && !rt.codec.fanOut.take(len(calls)) {
+		rt.codec.reject(w, calls, batch, http.StatusServiceUnavailable, ErrBusy)
+		return
+	}
+	if !batch {
+		rt.serveCall(w, r, calls[0], true)
+		return
+	}
+	// Calls of a batch cannot be answered with 304 Not Modified.
+	r = r.WithContext(r.Context())
+	r.Header = cloneHeader(r.Header)
+	r.Header.Del("If-Modified-Since")
+	if rt.codec.streamBatch {
+		rt.streamBatch(w, r, calls)
+		return
+	}
+	envs := make([][]byte, 0, len(calls))
+	partial := false
+	for _, c := range calls {
+		buf := newResponseBuffer()
+		if rt.serveCall(buf, r, c, rt.codec.batchTimeout != BatchTimeoutWait) {
+			partial = true
+		}
+		if env := rt.batchEnvelope(buf, c); env != nil {
+			envs = append(envs, env)
+		}
+	}
+	if partial && rt.codec.partialHeader {
+		w.Header().Set(partialHeader, "true")
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(append(joinEnvelopes(envs), '\n'))
+}
+
+// streamBatch answers the calls of a batch, writing and flushing the
+// envelope of each call as soon as it completes. The header is sent before
+// the first call is served, so the partial header is sent as a trailer.
+func (rt *Router) streamBatch(w http.ResponseWriter, r *http.Request, calls []*call) {
+	h := w.Header()
+	if rt.codec.partialHeader {
+		h.Set("Trailer", partialHeader)
+	}
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	h.Del("Content-Length")
+	flush := func() {}
+	if f, ok := w.(http.Flusher); ok {
+		flush = f.Flush
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte{'['})
+	flush()
+	partial, first := false, true
+	for _, c := range calls {
+		buf := newResponseBuffer()
+		if rt.serveCall(buf, r, c, rt.codec.batchTimeout != BatchTimeoutWait) {
+			partial = true
+		}
+		env := rt.batchEnvelope(buf, c)
+		if env == nil {
+			continue
+		}
+		if !first {
+			w.Write([]byte{','})
+		}
+		first = false
+		w.Write(env)
+		flush()
+	}
+	w.Write([]byte("]\n"))
+	if partial && rt.codec.partialHeader {
+		h.Set(partialHeader, "true")
+	}
+}
+
+// serveCall dispatches a single call, applying the call timeout if timeout
+// is true. It reports whether the call timed out.
+func (rt *Router) serveCall(w http.ResponseWriter, r *http.Request, c *call, timeout bool) (timedOut bool) {
+	sub := r.WithContext(r.Context())
+	sub.Body = ioutil.NopCloser(bytes.NewReader(c.body))
+	sub.ContentLength = int64(len(c.body))
+	if sub.Method == "GET" {
+		// The rpc server only serves POST requests.
+		sub.Method = "POST"
+		sub.Header = cloneHeader(sub.Header)
+		sub.Header.Del("Content-Length")
+	}
+	if err := rt.checkServed(c.req.Action, c.req.Method); err != nil {
+		rt.codec.writeEnvelope(w, http.StatusInternalServerError, exception(c.req, err))
+		return false
+	}
+	if err := rt.codec.checkRequest(c.req); err != nil {
+		rt.codec.writeEnvelope(w, http.StatusBadRequest, exception(c.req, err))
+		return false
+	}
+	if err := rt.codec.checkMethod(c.req.Action, c.req.Method); err != nil {
+		rt.codec.writeEnvelope(w, http.StatusBadRequest, exception(c.req, err))
+		return false
+	}
+	if err := rt.codec.checkData(c.req); err != nil {
+		rt.codec.writeEnvelope(w, http.StatusRequestEntityTooLarge, exception(c.req, err))
+		return false
+	}
+	release := func() {}
+	if sem := rt.codec.semaphore(c.req.Action, c.req.Method); sem != nil {
+		select {
+		case sem <- struct{}{}:
+			release = func() { <-sem }
+		default:
+			rt.codec.writeEnvelope(w, http.StatusServiceUnavailable, exception(c.req, ErrBusy))
+			return false
+		}
+	}
+	d := rt.codec.timeout(r)
+	if d <= 0 || !timeout {
+		defer release()
+		defer func() {
+			if p := recover(); p != nil {
+				rt.codec.writeEnvelope(w, http.StatusInternalServerError, rt.panicked(c, p))
+			}
+		}()
+		rt.dispatch(w, sub, c)
+		return false
+	}
+	return rt.dispatchTimeout(w, sub, c, d, release)
+}
+
+// timeout returns the timeout of the calls of r: the codec call timeout,
+// shortened to the deadline set by the client if the codec uses
+// WithClientDeadline. Zero means no timeout.
+func (c *Codec) timeout(r *http.Request) time.Duration {
+	d := c.callTimeout
+	if c.maxDeadline <= 0 {
+		return d
+	}
+	ms, err := strconv.ParseInt(r.Header.Get(deadlineHeader), 10, 64)
+	if err != nil || ms <= 0 {
+		return d
+	}
+	client := c.maxDeadline
+	if ms < int64(client/time.Millisecond) {
+		client = time.Duration(ms) * time.Millisecond
+	}
+	if d <= 0 || client < d {
+		d = client
+	}
+	return d
+}
+
+// dispatch passes a single call to the server.
+func (rt *Router) dispatch(w http.ResponseWriter, r *http.Request, c *call) {
+	if m := rt.codec.lookup(c.req.Action, c.req.Method); m != nil && m.Coalesce && m.Read {
+		rt.codec.inflight.serve(w, r, c.req, rt.server.ServeHTTP)
+		return
+	}
+	if rt.codec.dedupe != nil {
+		var ack func(http.ResponseWriter, *serverRequest)
+		if rt.codec.duplicateAck {
+			ack = rt.codec.ackDuplicate
+		}
+		rt.codec.dedupe.serve(w, r, c.req, rt.server.ServeHTTP, ack)
+		return
+	}
+	rt.server.ServeHTTP(w, r)
+}
+
+// panicked logs the panic p of the call c and returns the exception
+// answering c. It must be called by the function recovering the panic, so
+// that in debug mode the exception carries the stack of the panic.
+func (rt *Router) panicked(c *call, p interface{}) *Envelope {
+	rt.codec.logf("rpc: panic serving %s.%s: %v", c.req.Action, c.req.Method, p)
+	env := exception(c.req, errors.New("rpc: internal error"))
+	if rt.codec.debug && !rt.codec.noStack {
+		env.Where = stack()
+	}
+	return env
+}
+
+// dispatchTimeout dispatches a call with the timeout d. If the call does
+// not complete in time it is answered with an ErrTimeout exception and its
+// response, when it comes, is discarded. The context of the call is
+// canceled on timeout. release is called once the call completes.
+func (rt *Router) dispatchTimeout(w http.ResponseWriter, r *http.Request, c *call, d time.Duration, release func()) (timedOut bool) {
+	ctx, cancel := context.WithTimeout(r.Context(), d)
+	r = r.WithContext(ctx)
+	buf := newResponseBuffer()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer release()
+		defer cancel()
+		defer func() {
+			// The call runs outside of the goroutine of the HTTP server,
+			// which would otherwise recover the panic.
+			if p := recover(); p != nil {
+				buf = newResponseBuffer()
+				rt.codec.writeEnvelope(buf, http.StatusInternalServerError, rt.panicked(c, p))
+			}
+		}()
+		rt.dispatch(buf, r, c)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		select {
+		case <-done:
+		default:
+			rt.codec.writeEnvelope(w, http.StatusGatewayTimeout, exception(c.req, ErrTimeout))
+			return true
+		}
+	}
+	buf.writeTo(w, nil)
+	return false
+}
+
+// batchEnvelope returns the envelope answering c in a batch, from its
+// buffered response, or nil if there is none. Errors reported by the
+// server outside of an envelope are turned into exceptions.
+func (rt *Router) batchEnvelope(buf *responseBuffer, c *call) []byte {
+	body := bytes.TrimSpace(buf.body)
+	success := buf.status >= 200 && buf.status < 300
+	switch {
+	case success && len(body) == 0:
+		return nil
+	case strings.HasPrefix(buf.header.Get("Content-Type"), "application/json"):
+		return body
+	case !success:
+		return rt.codec.encodeEnvelope(exception(c.req, errors.New(string(body))))
+	}
+	return rt.codec.encodeEnvelope(exception(c.req, errors.New("rpc: response cannot be batched")))
+}
+
+// reject answers all calls with an exception for err without dispatching
+// them.
+func (c *Codec) reject(w http.ResponseWriter, calls []*call, batch bool, status int, err error) {
+	if !batch {
+		c.writeEnvelope(w, status, exception(calls[0].req, err))
+		return
+	}
+	envs := make([][]byte, len(calls))
+	for i, call := range calls {
+		envs[i] = c.encodeEnvelope(exception(call.req, err))
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(append(joinEnvelopes(envs), '\n'))
+}
+
+// readCalls reads the calls of r. Form posts are parsed in place so that
+// the codec finds the parsed form. err reports a failure to read the body
+// or ErrContentLength if its length differs from the declared one.
+func readCalls(r *http.Request) (calls []*call, batch bool, ok bool, err error) {
+	if r.Method == "GET" {
+		c, err := queryCall(r)
+		return []*call{c}, false, err == nil, err
+	}
+	if isForm(r) {
+		c := &call{req: new(serverRequest)}
+		_, err = readForm(r, c.req)
+		return []*call{c}, false, err == nil, err
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err == nil {
+		err = checkContentLength(r, len(body))
+	}
+	calls, batch, ok = parseCalls(body)
+	return calls, batch, ok && (err == nil || err == ErrContentLength), err
+}
+
+// queryCall returns the call of a GET request, described by the action,
+// method, tid and data query parameters. data holds the JSON data array and
+// may be omitted.
+func queryCall(r *http.Request) (*call, error) {
+	q := r.URL.Query()
+	req := &serverRequest{
+		Action: q.Get("action"),
+		Method: q.Get("method"),
+		Type:   "rpc",
+	}
+	if tid := q.Get("tid"); tid != "" {
+		var id json.RawMessage
+		if _, err := strconv.ParseUint(tid, 10, 64); err == nil {
+			id = json.RawMessage(tid)
+		} else {
+			id, _ = json.Marshal(tid)
+		}
+		req.Id = &id
+	}
+	if data := q.Get("data"); data != "" {
+		raw := json.RawMessage(data)
+		req.Params = &raw
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return &call{req: &serverRequest{Action: req.Action, Method: req.Method, Id: req.Id}}, err
+	}
+	return &call{req: req, body: body}, nil
+}
+
+// parseCalls returns the calls held by a request body. ok is false if the
+// body cannot be decoded, in which case it is returned as a single call so
+// that the server reports the error.
+func parseCalls(body []byte) (calls []*call, batch bool, ok bool) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var raws []json.RawMessage
+		if err := json.Unmarshal(trimmed, &raws); err == nil {
+			calls = make([]*call, len(raws))
+			for i, raw := range raws {
+				calls[i] = &call{req: new(serverRequest), body: raw}
+				json.Unmarshal(raw, calls[i].req)
+			}
+			return calls, true, true
+		}
+	}
+	c := &call{req: new(serverRequest), body: body}
+	ok = json.Unmarshal(body, c.req) == nil
+	return []*call{c}, false, ok
+}
+
+// matchesShape reports whether the batch header of r, if any, agrees with
+// the shape of its body.
+func matchesShape(r *http.Request, batch bool) bool {
+	v := r.Header.Get(batchHeader)
+	if v == "" {
+		return true
+	}
+	claimed, err := strconv.ParseBool(v)
+	return err == nil && claimed == batch
+}
+
+// headerSize returns the size of the request line and headers of r, as
+// counted by http.Server.MaxHeaderBytes.
+func headerSize(r *http.Request) int {
+	n := len(r.Method) + len(r.RequestURI) + len(r.Proto) + 4
+	if r.Host != "" {
+		n += len("Host: ") + len(r.Host) + 2
+	}
+	for k, v := range r.Header {
+		for _, s := range v {
+			n += len(k) + len(s) + 4
+		}
+	}
+	return n
+}
+
+// cloneHeader returns a copy of h.
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+// joinEnvelopes returns the encoded envelopes as a JSON array.
+func joinEnvelopes(envs [][]byte) []byte {
+	return append(append([]byte{'['}, bytes.Join(envs, []byte{','})...), ']')
+}
@@ -0,0 +1,1131 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/rpc"
+)
+
+type WhoAmI struct{}
+
+func (s *WhoAmI) Get(r *http.Request, req *struct{}, res *string) error {
+	p, ok := PrincipalFromContext(r.Context())
+	if !ok {
+		return errors.New("no principal")
+	}
+	*res = p.(string)
+	return nil
+}
+
+type Trace struct{}
+
+func (s *Trace) RequestID(r *http.Request, req *struct{}, res *string) error {
+	*res, _ = RequestIDFromContext(r.Context())
+	return nil
+}
+
+func (s *Trace) Correlation(r *http.Request, req *struct{}, res *string) error {
+	*res, _ = CorrelationIDFromContext(r.Context())
+	return nil
+}
+
+func (s *Trace) Tid(r *http.Request, req *struct{}, res *string) error {
+	*res, _ = TidFromContext(r.Context())
+	return nil
+}
+
+func newRouter(c *Codec, services ...interface{}) *Router {
+	s := rpc.NewServer()
+	s.RegisterCodec(c, "application/json")
+	for _, service := range services {
+		s.RegisterService(service, "")
+	}
+	return NewRouter(s, c)
+}
+
+func route(rt http.Handler, r *http.Request) (*httptest.ResponseRecorder, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, r)
+	var env map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &env)
+	return w, env
+}
+
+func TestRouterTokenAuth(t *testing.T) {
+	rt := newRouter(NewCodec(WithTokenAuth(func(token string) (Principal, error) {
+		if token != "secret" {
+			return nil, errors.New("invalid token")
+		}
+		return "alice", nil
+	})), new(WhoAmI))
+	body := `{"action":"WhoAmI","method":"Get","type":"rpc","tid":3,"data":null}`
+
+	r := newRequest(body)
+	r.Header.Set("Authorization", "Bearer secret")
+	w, env := route(rt, r)
+	if w.Code != 200 || env["result"] != "alice" {
+		t.Errorf("Expected principal alice, but got %v %v", w.Code, env)
+	}
+
+	r = newRequest(body)
+	r.Header.Set("Authorization", "Bearer wrong")
+	w, env = route(rt, r)
+	if w.Code != 401 {
+		t.Errorf("Expected http response code 401, but got %v", w.Code)
+	}
+	if env["type"] != "exception" || env["message"] != "invalid token" || env["tid"] != 3.0 {
+		t.Errorf("Expected exception envelope, but got %v", env)
+	}
+
+	if w, _ = route(rt, newRequest(body)); w.Code != 401 {
+		t.Errorf("Expected http response code 401 without token, but got %v", w.Code)
+	}
+}
+
+type Counter struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (c *Counter) Add(r *http.Request, req *int, res *int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	*res = *req + c.calls
+	return nil
+}
+
+// tokenPrincipal authenticates the token itself as the principal.
+func tokenPrincipal(token string) (Principal, error) {
+	return token, nil
+}
+
+// newUserRequest returns a request made by principal, authenticated with
+// tokenPrincipal.
+func newUserRequest(principal, body string) *http.Request {
+	r := newRequest(body)
+	r.Header.Set("Authorization", "Bearer "+principal)
+	return r
+}
+
+func TestRouterDedupe(t *testing.T) {
+	counter := new(Counter)
+	rt := newRouter(NewCodec(WithDedupe(time.Minute, nil), WithTokenAuth(tokenPrincipal)), counter)
+
+	_, env := route(rt, newUserRequest("alice", `{"action":"Counter","method":"Add","type":"rpc","tid":1,"data":[10]}`))
+	if env["result"] != 11.0 || env["tid"] != 1.0 {
+		t.Errorf("Expected result 11 for tid 1, but got %v", env)
+	}
+	_, env = route(rt, newUserRequest("alice", `{"action":"Counter","method":"Add","type":"rpc","tid":2,"data":[10]}`))
+	if env["result"] != 11.0 || env["tid"] != 2.0 {
+		t.Errorf("Expected deduplicated result 11 for tid 2, but got %v", env)
+	}
+	if counter.calls != 1 {
+		t.Errorf("Expected 1 dispatch, but got %d", counter.calls)
+	}
+
+	_, env = route(rt, newUserRequest("alice", `{"action":"Counter","method":"Add","type":"rpc","tid":3,"data":[20]}`))
+	if env["result"] != 22.0 || counter.calls != 2 {
+		t.Errorf("Expected a new dispatch for different data, but got %v", env)
+	}
+	_, env = route(rt, newUserRequest("bob", `{"action":"Counter","method":"Add","type":"rpc","tid":4,"data":[10]}`))
+	if env["result"] != 13.0 || counter.calls != 3 {
+		t.Errorf("Expected a new dispatch for another principal, but got %v", env)
+	}
+
+	// Anonymous calls are not deduplicated by default.
+	counter = new(Counter)
+	rt = newRouter(NewCodec(WithDedupe(time.Minute, nil)), counter)
+	for i, want := range []float64{11, 12} {
+		_, env = route(rt, newRequest(`{"action":"Counter","method":"Add","type":"rpc","tid":1,"data":[10]}`))
+		if env["result"] != want {
+			t.Errorf("Expected result %v for anonymous call %d, but got %v", want, i, env)
+		}
+	}
+}
+
+func TestRouterDuplicateAck(t *testing.T) {
+	counter := new(Counter)
+	rt := newRouter(NewCodec(WithDedupe(time.Minute, nil), WithDuplicateAck(), WithTokenAuth(tokenPrincipal)), counter)
+
+	_, env := route(rt, newUserRequest("alice", `{"action":"Counter","method":"Add","type":"rpc","tid":1,"data":[10]}`))
+	if env["result"] != 11.0 {
+		t.Errorf("Expected result 11 for the first call, but got %v", env)
+	}
+	_, env = route(rt, newUserRequest("alice", `{"action":"Counter","method":"Add","type":"rpc","tid":2,"data":[10]}`))
+	result, _ := env["result"].(map[string]interface{})
+	if len(result) != 1 || result["duplicate"] != true || env["tid"] != 2.0 || env["type"] != "rpc" {
+		t.Errorf("Expected the duplicate marker for tid 2, but got %v", env)
+	}
+	if counter.calls != 1 {
+		t.Errorf("Expected 1 dispatch, but got %d", counter.calls)
+	}
+}
+
+func TestRouterBatch(t *testing.T) {
+	rt := newRouter(NewCodec(), new(Service1))
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, newRequest(`[
+		{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":[{"A":4,"B":2}]},
+		{"action":"Service1","method":"Multiply","type":"rpc","data":[{"A":1,"B":1}]},
+		{"action":"Service1","method":"Missing","type":"rpc","tid":2,"data":null},
+		{"action":"Service1","method":"ResponseError","type":"rpc","tid":3,"data":[{}]}
+	]`))
+	var envs []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &envs); err != nil {
+		t.Fatalf("Expected an array of envelopes, but got %q", w.Body.String())
+	}
+	if len(envs) != 3 {
+		t.Fatalf("Expected 3 envelopes, but got %v", envs)
+	}
+	if envs[0]["tid"] != 1.0 || envs[0]["result"].(map[string]interface{})["Result"] != 8.0 {
+		t.Errorf("Expected result 8 for tid 1, but got %v", envs[0])
+	}
+	if envs[1]["tid"] != 2.0 || envs[1]["type"] != "exception" {
+		t.Errorf("Expected exception for unknown method, but got %v", envs[1])
+	}
+	if envs[2]["tid"] != 3.0 || envs[2]["message"] != ErrResponseError.Error() {
+		t.Errorf("Expected method error for tid 3, but got %v", envs[2])
+	}
+}
+
+func TestRouterShape(t *testing.T) {
+	single := `{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":[{"A":4,"B":2}]}`
+	batch := "[" + single + "]"
+
+	// By default the body decides.
+	rt := newRouter(NewCodec(), new(Service1))
+	r := newRequest(single)
+	r.Header.Set("X-RPC-Batch", "true")
+	if w, env := route(rt, r); w.Code != 200 || env["type"] != "rpc" {
+		t.Errorf("Expected single response, but got %v %q", w.Code, w.Body.String())
+	}
+
+	rt = newRouter(NewCodec(WithStrictShape()), new(Service1))
+	r = newRequest(single)
+	r.Header.Set("X-RPC-Batch", "true")
+	if w, env := route(rt, r); w.Code != 400 || env["message"] != ErrShapeMismatch.Error() || env["tid"] != 1.0 {
+		t.Errorf("Expected shape mismatch exception, but got %v %q", w.Code, w.Body.String())
+	}
+	r = newRequest(batch)
+	r.Header.Set("X-RPC-Batch", "false")
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, r)
+	var envs []map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &envs)
+	if w.Code != 400 || len(envs) != 1 || envs[0]["message"] != ErrShapeMismatch.Error() {
+		t.Errorf("Expected shape mismatch exceptions, but got %v %q", w.Code, w.Body.String())
+	}
+	r = newRequest(batch)
+	r.Header.Set("X-RPC-Batch", "true")
+	if w, _ := route(rt, r); w.Code != 200 {
+		t.Errorf("Expected matching batch to be served, but got %v %q", w.Code, w.Body.String())
+	}
+}
+
+func TestRouterSetAccepting(t *testing.T) {
+	rt := newRouter(NewCodec(), new(Service1))
+	body := `{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":[{"A":4,"B":2}]}`
+
+	rt.SetAccepting(false)
+	w, env := route(rt, newRequest(body))
+	if w.Code != 503 || env["type"] != "exception" || env["code"] != "maintenance" {
+		t.Errorf("Expected maintenance exception, but got %v %q", w.Code, w.Body.String())
+	}
+
+	rt.SetAccepting(true)
+	if w, env = route(rt, newRequest(body)); w.Code != 200 || env["type"] != "rpc" {
+		t.Errorf("Expected call to be served, but got %v %q", w.Code, w.Body.String())
+	}
+}
+
+type Reports struct {
+	started chan bool
+	release chan bool
+}
+
+func (s *Reports) Generate(r *http.Request, req *struct{}, res *string) error {
+	s.started <- true
+	<-s.release
+	*res = "done"
+	return nil
+}
+
+func TestRouterActionConcurrency(t *testing.T) {
+	reports := &Reports{started: make(chan bool), release: make(chan bool)}
+	rt := newRouter(NewCodec(WithActionConcurrency(map[string]int{"Reports": 1})), reports, new(Service1))
+	report := `{"action":"Reports","method":"Generate","type":"rpc","tid":1,"data":null}`
+
+	done := make(chan map[string]interface{})
+	go func() {
+		_, env := route(rt, newRequest(report))
+		done <- env
+	}()
+	<-reports.started
+
+	w, env := route(rt, newRequest(report))
+	if w.Code != 503 || env["code"] != "busy" {
+		t.Errorf("Expected busy exception, but got %v %q", w.Code, w.Body.String())
+	}
+	_, env = route(rt, newRequest(`{"action":"Service1","method":"Multiply","type":"rpc","tid":2,"data":[{"A":4,"B":2}]}`))
+	if env["type"] != "rpc" {
+		t.Errorf("Expected other action to proceed, but got %v", env)
+	}
+
+	reports.release <- true
+	if env = <-done; env["result"] != "done" {
+		t.Errorf("Expected saturating call to complete, but got %v", env)
+	}
+}
+
+func TestRouterActionConcurrencyCase(t *testing.T) {
+	reg := NewRegistry()
+	reg.Add("SlowReport", "Load")
+	report := &SlowReport{started: make(chan struct{}), release: make(chan struct{})}
+	c := NewCodec(WithRegistry(reg), WithCaseInsensitive(), WithActionConcurrency(map[string]int{"SlowReport.Load": 1}))
+	rt := newRouter(c, report)
+
+	go route(rt, newRequest(`{"action":"SlowReport","method":"Load","type":"rpc","tid":1,"data":[1]}`))
+	<-report.started
+	shifted := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w, _ := route(rt, newRequest(`{"action":"slowreport","method":"LOAD","type":"rpc","tid":2,"data":[1]}`))
+		shifted <- w
+	}()
+	select {
+	case w := <-shifted:
+		if w.Code != 503 || !strings.Contains(w.Body.String(), `"code":"busy"`) {
+			t.Errorf("Expected the case-shifted call to be limited, but got %v %q", w.Code, w.Body.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the case-shifted call to be limited, but it was dispatched")
+	}
+	close(report.release)
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic for a limit of 0")
+		}
+	}()
+	WithActionConcurrency(map[string]int{"SlowReport": 0})
+}
+
+func TestRouterMethodValidation(t *testing.T) {
+	reg := NewRegistry()
+	reg.Add("Service1", "Multiply")
+	rt := newRouter(NewCodec(WithRegistry(reg), WithMethodValidation()), new(Service1))
+
+	// ResponseError exists in the rpc server but not in the registry.
+	w, env := route(rt, newRequest(`{"action":"Service1","method":"ResponseError","type":"rpc","tid":4,"data":[{}]}`))
+	if w.Code != 400 || env["type"] != "exception" || env["tid"] != 4.0 {
+		t.Errorf("Expected exception envelope, but got %v %q", w.Code, w.Body.String())
+	}
+	if env["message"] != "rpc: unknown method Service1.ResponseError" || env["action"] != "Service1" || env["method"] != "ResponseError" {
+		t.Errorf("Expected exception naming the method, but got %v", env)
+	}
+
+	if _, env = route(rt, newRequest(`{"action":"Service1","method":"Multiply","type":"rpc","tid":5,"data":[{"A":4,"B":2}]}`)); env["type"] != "rpc" {
+		t.Errorf("Expected registered method to be served, but got %v", env)
+	}
+}
+
+func TestRouterPartialBatch(t *testing.T) {
+	rt := newRouter(NewCodec(WithCallTimeout(50*time.Millisecond), WithPartialHeader()), new(Service1))
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, newRequest(`[
+		{"action":"Service1","method":"Sleep","type":"rpc","tid":1,"data":[{"A":500}]},
+		{"action":"Service1","method":"Multiply","type":"rpc","tid":2,"data":[{"A":4,"B":2}]}
+	]`))
+	if h := w.Header().Get("X-RPC-Partial"); h != "true" {
+		t.Errorf("Expected X-RPC-Partial header, but got %q", h)
+	}
+	var envs []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &envs); err != nil || len(envs) != 2 {
+		t.Fatalf("Expected 2 envelopes, but got %q", w.Body.String())
+	}
+	if envs[0]["tid"] != 1.0 || envs[0]["code"] != "timeout" {
+		t.Errorf("Expected timeout exception for tid 1, but got %v", envs[0])
+	}
+	if envs[1]["tid"] != 2.0 || envs[1]["type"] != "rpc" {
+		t.Errorf("Expected result for tid 2, but got %v", envs[1])
+	}
+
+	w = httptest.NewRecorder()
+	rt.ServeHTTP(w, newRequest(`[{"action":"Service1","method":"Multiply","type":"rpc","tid":3,"data":[{"A":4,"B":2}]}]`))
+	if h := w.Header().Get("X-RPC-Partial"); h != "" {
+		t.Errorf("Expected no X-RPC-Partial header, but got %q", h)
+	}
+}
+
+func TestRouterBatchTimeoutPolicy(t *testing.T) {
+	batch := `[
+		{"action":"Service1","method":"Sleep","type":"rpc","tid":1,"data":[{"A":100}]},
+		{"action":"Service1","method":"Multiply","type":"rpc","tid":2,"data":[{"A":4,"B":2}]}
+	]`
+	for _, policy := range []BatchTimeoutPolicy{BatchTimeoutEarly, BatchTimeoutWait} {
+		rt := newRouter(NewCodec(WithCallTimeout(20*time.Millisecond), WithBatchTimeoutPolicy(policy)), new(Service1))
+		w := httptest.NewRecorder()
+		start := time.Now()
+		rt.ServeHTTP(w, newRequest(batch))
+		elapsed := time.Since(start)
+		var envs []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &envs); err != nil || len(envs) != 2 {
+			t.Fatalf("Expected 2 envelopes, but got %q", w.Body.String())
+		}
+		if envs[1]["tid"] != 2.0 || envs[1]["type"] != "rpc" {
+			t.Errorf("Policy %d: expected result for tid 2, but got %v", policy, envs[1])
+		}
+		if policy == BatchTimeoutEarly {
+			if envs[0]["code"] != "timeout" || elapsed >= 100*time.Millisecond {
+				t.Errorf("Expected an early timeout exception, but got %v after %v", envs[0], elapsed)
+			}
+			continue
+		}
+		if envs[0]["tid"] != 1.0 || envs[0]["type"] != "rpc" || elapsed < 100*time.Millisecond {
+			t.Errorf("Expected the batch to wait for tid 1, but got %v after %v", envs[0], elapsed)
+		}
+		// Single calls still time out.
+		if w, env := route(rt, newRequest(`{"action":"Service1","method":"Sleep","type":"rpc","tid":3,"data":[{"A":100}]}`)); env["code"] != "timeout" {
+			t.Errorf("Expected a single call to time out, but got %v %v", w.Code, env)
+		}
+	}
+}
+
+func TestRouterRequestID(t *testing.T) {
+	rt := newRouter(NewCodec(WithRequestID(true)), new(Trace))
+	body := `{"action":"Trace","method":"RequestID","type":"rpc","tid":1,"data":null}`
+
+	r := newRequest(body)
+	r.Header.Set("X-Request-Id", "gw-42")
+	w, env := route(rt, r)
+	if env["result"] != "gw-42" || w.Header().Get("X-Request-Id") != "gw-42" {
+		t.Errorf("Expected inbound id gw-42, but got %v %q", env, w.Header().Get("X-Request-Id"))
+	}
+
+	w, env = route(rt, newRequest(body))
+	id, _ := env["result"].(string)
+	if id == "" || w.Header().Get("X-Request-Id") != id {
+		t.Errorf("Expected a generated id, but got %v %q", env, w.Header().Get("X-Request-Id"))
+	}
+
+	// The calls of a batch share the request id.
+	r = newRequest("[" + body + "," + body + "]")
+	w = httptest.NewRecorder()
+	rt.ServeHTTP(w, r)
+	var envs []map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &envs)
+	if len(envs) != 2 || envs[0]["result"] == "" || envs[0]["result"] != envs[1]["result"] {
+		t.Errorf("Expected a shared id, but got %v", envs)
+	}
+
+	// Without a router the codec assigns ids too.
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(WithRequestID(false)), "application/json")
+	s.RegisterService(new(Trace), "")
+	r = newRequest(body)
+	r.Header.Set("X-Request-Id", "gw-43")
+	w = serve(s, r)
+	if !strings.Contains(w.Body.String(), `"result":"gw-43"`) || w.Header().Get("X-Request-Id") != "" {
+		t.Errorf("Expected inbound id without echo, but got %q %v", w.Body.String(), w.Header())
+	}
+}
+
+func TestRouterCanonicalTid(t *testing.T) {
+	rt := newRouter(NewCodec(WithCanonicalTid()), new(Trace))
+	for tid, want := range map[string]string{
+		`7`:     "7",
+		`7.0`:   "7",
+		`1e3`:   "1000",
+		`-2.5`:  "-2.5",
+		`"a-7"`: "a-7",
+	} {
+		w, env := route(rt, newRequest(`{"action":"Trace","method":"Tid","type":"rpc","tid":`+tid+`,"data":null}`))
+		if env["result"] != want {
+			t.Errorf("Expected canonical tid %q for %s, but got %v", want, tid, env)
+		}
+		if got := strings.SplitN(strings.SplitN(w.Body.String(), `"tid":`, 2)[1], ",", 2)[0]; got != tid {
+			t.Errorf("Expected tid %s echoed as sent, but got %s", tid, got)
+		}
+	}
+
+	for _, tid := range []string{`""`, `{"id":1}`, `[1]`} {
+		if w, env := route(rt, newRequest(`{"action":"Trace","method":"Tid","type":"rpc","tid":`+tid+`,"data":null}`)); w.Code != 400 || env["type"] != "exception" {
+			t.Errorf("Expected tid %s rejected with an exception, but got %v %v", tid, w.Code, env)
+		}
+	}
+}
+
+func TestRouterRejectedRequest(t *testing.T) {
+	for _, test := range []struct {
+		opt  Option
+		body string
+	}{
+		{WithStrictTid(), `{"action":"Trace","method":"Tid","type":"rpc","tid":{"a":1},"data":null}`},
+		{WithStrictType(), `{"action":"Trace","method":"Tid","type":"RPC","tid":1,"data":null}`},
+	} {
+		rt := newRouter(NewCodec(test.opt), new(Trace))
+		w, env := route(rt, newRequest(test.body))
+		if w.Code != 400 || env["type"] != "exception" || !strings.Contains(w.Header().Get("Content-Type"), "json") {
+			t.Errorf("Expected an exception envelope for %s, but got %v %q", test.body, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRequireTLS(t *testing.T) {
+	c := NewCodec()
+	h := RequireTLS(c, TLSPolicy{ProtoHeader: "X-Forwarded-Proto"}, newRouter(c, new(Trace)))
+	body := `{"action":"Trace","method":"RequestID","type":"rpc","tid":5,"data":null}`
+
+	w, env := route(h, newRequest(body))
+	if w.Code != http.StatusForbidden || env["type"] != "exception" || env["code"] != "insecure" || env["tid"] != float64(5) {
+		t.Errorf("Expected insecure exception for a plaintext request, but got %v %v", w.Code, env)
+	}
+
+	r := newRequest(body)
+	r.TLS = &tls.ConnectionState{}
+	if w, env := route(h, r); w.Code != 200 || env["type"] != "rpc" {
+		t.Errorf("Expected TLS request to pass, but got %v %v", w.Code, env)
+	}
+
+	r = newRequest(body)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	if w, env := route(h, r); w.Code != 200 || env["type"] != "rpc" {
+		t.Errorf("Expected request forwarded over https to pass, but got %v %v", w.Code, env)
+	}
+
+	// The header is not trusted unless configured.
+	h = RequireTLS(c, TLSPolicy{Redirect: true}, newRouter(c, new(Trace)))
+	if w, _ := route(h, r); w.Code != http.StatusForbidden {
+		t.Errorf("Expected untrusted header to be ignored, but got %v", w.Code)
+	}
+	r, _ = http.NewRequest("GET", "http://localhost:8080/api?format=json", nil)
+	if w, _ := route(h, r); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "https://localhost:8080/api?format=json" {
+		t.Errorf("Expected redirect to https, but got %v %v", w.Code, w.Header())
+	}
+
+	// Uploads and large bodies are rejected without being read.
+	for _, test := range []struct {
+		contentType string
+		size        int
+	}{
+		{"multipart/form-data; boundary=x", 100},
+		{"application/json", 1 << 20},
+	} {
+		body := &countingReader{r: strings.NewReader(strings.Repeat(" ", test.size))}
+		r, _ = http.NewRequest("POST", "http://localhost:8080/", body)
+		r.Header.Set("Content-Type", test.contentType)
+		w, env := route(h, r)
+		if w.Code != http.StatusForbidden || env["code"] != "insecure" {
+			t.Errorf("Expected insecure exception for %s, but got %v %v", test.contentType, w.Code, env)
+		}
+		if body.n > maxInsecureBody+1 || (test.size < maxInsecureBody && body.n != 0) {
+			t.Errorf("Expected the %s body not to be read, but %d bytes were", test.contentType, body.n)
+		}
+	}
+}
+
+func TestRouterFanOutLimit(t *testing.T) {
+	c := NewCodec(WithFanOutLimit(3, time.Minute))
+	now := time.Now()
+	c.fanOut.now = func() time.Time { return now }
+	rt := newRouter(c, new(Trace))
+	call := `{"action":"Trace","method":"RequestID","type":"rpc","tid":1,"data":null}`
+	batch := "[" + call + "," + call + "]"
+
+	batchEnvs := func() (int, []map[string]interface{}) {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, newRequest(batch))
+		var envs []map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &envs)
+		return w.Code, envs
+	}
+	if code, envs := batchEnvs(); code != 200 || len(envs) != 2 || envs[0]["type"] != "rpc" {
+		t.Fatalf("Expected the first batch to be served, but got %v %v", code, envs)
+	}
+	code, envs := batchEnvs()
+	if code != http.StatusServiceUnavailable || len(envs) != 2 {
+		t.Fatalf("Expected the second batch to be rejected, but got %v %v", code, envs)
+	}
+	for _, env := range envs {
+		if env["type"] != "exception" || env["code"] != "busy" {
+			t.Errorf("Expected busy exception, but got %v", env)
+		}
+	}
+	// Single calls are not part of the fan-out budget.
+	if w, env := route(rt, newRequest(call)); w.Code != 200 || env["type"] != "rpc" {
+		t.Errorf("Expected single call to be served, but got %v %v", w.Code, env)
+	}
+	// The budget refills over time.
+	now = now.Add(40 * time.Second)
+	if code, envs := batchEnvs(); code != 200 || len(envs) != 2 {
+		t.Errorf("Expected the batch to be served after refill, but got %v %v", code, envs)
+	}
+
+	for _, test := range []struct {
+		limit int
+		per   time.Duration
+	}{{3, 0}, {0, time.Minute}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected a panic for %d per %v", test.limit, test.per)
+				}
+			}()
+			WithFanOutLimit(test.limit, test.per)
+		}()
+	}
+}
+
+func TestRecentErrors(t *testing.T) {
+	c := NewCodec(WithRecentErrors(2), WithDebug())
+	mux := http.NewServeMux()
+	newRouter(c, new(Service1)).Mount(mux, "/direct", "")
+	for _, method := range []string{"ResponseError", "Multiply", "Expired", "PartialError"} {
+		r := newRequest(`{"action":"Service1","method":"` + method + `","type":"rpc","tid":1,"data":[{"A":4,"B":2}]}`)
+		r.URL.Path = "/direct/router"
+		route(mux, r)
+	}
+	errs := c.RecentErrors()
+	if len(errs) != 2 {
+		t.Fatalf("Expected the last 2 errors, but got %v", errs)
+	}
+	if errs[0].Method != "Expired" || errs[0].Code != "reauth" || errs[0].Message != "session expired" {
+		t.Errorf("Expected the Expired error first, but got %+v", errs[0])
+	}
+	if errs[1].Action != "Service1" || errs[1].Method != "PartialError" || errs[1].Time.IsZero() {
+		t.Errorf("Expected the PartialError error last, but got %+v", errs[1])
+	}
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/direct/errors", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	var served []ErrorRecord
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil || len(served) != 2 {
+		t.Errorf("Expected the errors to be served, but got %q", w.Body.String())
+	}
+
+	// The handler is gated by debug mode.
+	w = httptest.NewRecorder()
+	NewCodec(WithRecentErrors(2)).RecentErrorsHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 outside debug mode, but got %v", w.Code)
+	}
+}
+
+func TestRouterMaxDataSize(t *testing.T) {
+	reg := NewRegistry()
+	reg.Add("Service1", "Multiply").MaxDataSize = 16
+	reg.Add("Service1", "Sleep").MaxDataSize = 64
+	rt := newRouter(NewCodec(WithRegistry(reg)), new(Service1))
+	data := `[{"A":1,"B":2,"C":"padding"}]`
+
+	w, env := route(rt, newRequest(`{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":`+data+`}`))
+	if w.Code != http.StatusRequestEntityTooLarge || env["code"] != "too_large" || env["tid"] != float64(1) {
+		t.Errorf("Expected too_large exception, but got %v %v", w.Code, env)
+	}
+	w, env = route(rt, newRequest(`{"action":"Service1","method":"Sleep","type":"rpc","tid":2,"data":`+data+`}`))
+	if w.Code != 200 || env["type"] != "rpc" {
+		t.Errorf("Expected the same data to be accepted by Sleep, but got %v %v", w.Code, env)
+	}
+
+	// The codec enforces the limit without a router too.
+	w = serve(rt.server, newRequest(`{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":`+data+`}`))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), ErrDataTooLarge.Error()) {
+		t.Errorf("Expected the codec to reject the data, but got %v %q", w.Code, w.Body.String())
+	}
+}
+
+type SlowReport struct {
+	started chan struct{}
+	release chan struct{}
+	calls   int32
+}
+
+func (s *SlowReport) Load(r *http.Request, req *int, res *int) error {
+	if atomic.AddInt32(&s.calls, 1) == 1 {
+		close(s.started)
+	}
+	<-s.release
+	*res = *req * 2
+	return nil
+}
+
+// arrivingPrincipal is a principal signaling on arrived each time it is
+// formatted, as when the key of a call to coalesce is computed.
+type arrivingPrincipal struct {
+	name    string
+	arrived chan struct{}
+}
+
+func (p arrivingPrincipal) String() string {
+	p.arrived <- struct{}{}
+	return p.name
+}
+
+func TestRouterCoalesce(t *testing.T) {
+	const n = 10
+	reg := NewRegistry()
+	m := reg.Add("SlowReport", "Load")
+	m.Read, m.Coalesce = true, true
+	report := &SlowReport{started: make(chan struct{}), release: make(chan struct{})}
+	arrived := make(chan struct{}, n)
+	rt := newRouter(NewCodec(WithRegistry(reg), WithRequestID(true), WithTokenAuth(func(token string) (Principal, error) {
+		return arrivingPrincipal{token, arrived}, nil
+	})), report)
+
+	var wg sync.WaitGroup
+	envs := make([]map[string]interface{}, n)
+	ids := make([]string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := newUserRequest("alice", fmt.Sprintf(`{"action":"SlowReport","method":"Load","type":"rpc","tid":%d,"data":[21]}`, i))
+			r.Header.Set(requestIDHeader, fmt.Sprintf("client-%d", i))
+			var w *httptest.ResponseRecorder
+			w, envs[i] = route(rt, r)
+			ids[i] = w.Header().Get(requestIDHeader)
+		}(i)
+	}
+	// Release the call in flight once every call looked it up.
+	<-report.started
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < n; i++ {
+		select {
+		case <-arrived:
+		case <-timeout:
+			close(report.release)
+			t.Fatalf("Expected %d calls to be coalesced, but got %d", n, i)
+		}
+	}
+	close(report.release)
+	wg.Wait()
+
+	if calls := atomic.LoadInt32(&report.calls); calls != 1 {
+		t.Errorf("Expected a single dispatch, but got %d", calls)
+	}
+	for i, env := range envs {
+		if env["result"] != float64(42) || env["tid"] != float64(i) {
+			t.Errorf("Expected result 42 for tid %d, but got %v", i, env)
+		}
+		if want := fmt.Sprintf("client-%d", i); ids[i] != want {
+			t.Errorf("Expected request id %s, but got %s", want, ids[i])
+		}
+	}
+
+	// Completed calls are not remembered.
+	route(rt, newUserRequest("alice", `{"action":"SlowReport","method":"Load","type":"rpc","tid":1,"data":[21]}`))
+	<-arrived
+	if calls := atomic.LoadInt32(&report.calls); calls != 2 {
+		t.Errorf("Expected a new dispatch once the call completed, but got %d", calls)
+	}
+
+	// Anonymous calls are not coalesced: both calls wait for a release.
+	report = &SlowReport{started: make(chan struct{}), release: make(chan struct{})}
+	rt = newRouter(NewCodec(WithRegistry(reg)), report)
+	done := make(chan bool, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, env := route(rt, newRequest(`{"action":"SlowReport","method":"Load","type":"rpc","tid":1,"data":[21]}`))
+			done <- env["result"] == float64(42)
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case report.release <- struct{}{}:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected each anonymous call to be dispatched")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if !<-done {
+			t.Error("Expected result 42 for the anonymous calls")
+		}
+	}
+}
+
+func TestRouterGzipLevel(t *testing.T) {
+	var words []string
+	for i := 0; i < 5000; i++ {
+		words = append(words, fmt.Sprintf("item-%d", i*i%997))
+	}
+	text := strings.Join(words, " ")
+	data, _ := json.Marshal([]string{text})
+	body := `{"action":"Echo","method":"Say","type":"rpc","tid":1,"data":` + string(data) + `}`
+
+	sizes := make(map[int]int)
+	for _, level := range []int{gzip.BestSpeed, gzip.BestCompression} {
+		rt := newRouter(NewCodec(WithGzipLevel(level)), new(Echo))
+		r := newRequest(body)
+		r.Header.Set("Accept-Encoding", "gzip, deflate")
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, r)
+		if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("Expected a gzip response, but got %v", w.Header())
+		}
+		sizes[level] = w.Body.Len()
+		zr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var env map[string]interface{}
+		if err := json.NewDecoder(zr).Decode(&env); err != nil || env["result"] != text {
+			t.Errorf("Expected the echoed text, but got %v", err)
+		}
+	}
+	if sizes[gzip.BestCompression] >= sizes[gzip.BestSpeed] {
+		t.Errorf("Expected BestCompression to be smaller than BestSpeed, but got %v", sizes)
+	}
+
+	// Clients not accepting gzip get a plain response.
+	rt := newRouter(NewCodec(WithGzipLevel(100)), new(Echo))
+	if w, env := route(rt, newRequest(body)); w.Header().Get("Content-Encoding") != "" || env["result"] != text ||
+		w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Expected a plain response varying on Accept-Encoding, but got %v", w.Header())
+	}
+	if *rt.codec.gzipLevel != gzip.DefaultCompression {
+		t.Errorf("Expected an invalid level to use the default, but got %d", *rt.codec.gzipLevel)
+	}
+
+	// Responses without a body are not encoded.
+	for _, status := range []int{http.StatusAccepted, http.StatusNoContent} {
+		rt = newRouter(NewCodec(WithGzipLevel(gzip.BestSpeed), WithNotificationStatus(status)), new(Echo))
+		r := newRequest(`{"action":"Echo","method":"Say","type":"rpc","data":["hi"]}`)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, r)
+		if w.Code != status || w.Header().Get("Content-Encoding") != "" || w.Body.Len() != 0 {
+			t.Errorf("Expected an empty %d response, but got %v %v %q", status, w.Code, w.Header(), w.Body.String())
+		}
+	}
+}
+
+func TestRouterVerify(t *testing.T) {
+	reg := NewRegistry()
+	reg.Add("Service1", "Multiply")
+	reg.Add("Service1", "Divide")
+	reg.Add("Reports", "Run")
+	var buf bytes.Buffer
+	rt := newRouter(NewCodec(WithRegistry(reg), WithLogger(log.New(&buf, "", 0))), new(Service1))
+
+	err := rt.Verify()
+	if err == nil || !strings.Contains(err.Error(), "Reports.Run, Service1.Divide") {
+		t.Errorf("Expected Verify to report the missing methods, but got %v", err)
+	}
+
+	body := `{"action":"Service1","method":"Divide","type":"rpc","tid":4,"data":[{"A":4,"B":2}]}`
+	for i := 0; i < 2; i++ {
+		w, env := route(rt, newRequest(body))
+		if w.Code != http.StatusInternalServerError || env["type"] != "exception" || env["message"] != "rpc: method Service1.Divide is not served" {
+			t.Errorf("Expected a not served exception, but got %v %v", w.Code, env)
+		}
+	}
+	if n := strings.Count(buf.String(), "Service1.Divide is in the ExtDirect registry but not registered"); n != 1 {
+		t.Errorf("Expected the inconsistency to be logged once, but got %q", buf.String())
+	}
+
+	reg = NewRegistry()
+	reg.Add("Service1", "Multiply")
+	if err := newRouter(NewCodec(WithRegistry(reg)), new(Service1)).Verify(); err != nil {
+		t.Errorf("Expected a consistent registration to verify, but got %v", err)
+	}
+
+	reg = NewRegistry()
+	reg.Add("Tickets", "Get")
+	s := rpc.NewServer()
+	c := NewCodec(WithRegistry(reg))
+	s.RegisterCodec(c, "application/json")
+	if err := reg.RegisterService(s, new(Tickets), ""); err != nil {
+		t.Fatal(err)
+	}
+	err = NewRouter(s, c).Verify()
+	if err == nil || !strings.Contains(err.Error(), "registered with the rpc server but not in the ExtDirect registry: Tickets.Statuses") {
+		t.Errorf("Expected Verify to report the served methods missing from the registry, but got %v", err)
+	}
+	reg.Add("Tickets", "Statuses")
+	if err := NewRouter(s, c).Verify(); err != nil {
+		t.Errorf("Expected a complete registry to verify, but got %v", err)
+	}
+}
+
+func TestRouterReadWrite(t *testing.T) {
+	reg := NewRegistry()
+	reg.Add("Catalog", "Read").Read = true
+	reg.Add("Catalog", "Save")
+	rt := newRouter(NewCodec(WithRegistry(reg)), new(Catalog))
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/?action=Catalog&method=Read&tid=1", nil)
+	if w, env := route(rt, r); w.Code != 200 || env["tid"] != float64(1) || len(env["result"].([]interface{})) != 2 {
+		t.Errorf("Expected the read result via GET, but got %v %v", w.Code, env)
+	}
+
+	r, _ = http.NewRequest("GET", "http://localhost:8080/?action=Catalog&method=Save&tid=2&data=[[\"fig\"]]", nil)
+	w, env := route(rt, r)
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" {
+		t.Errorf("Expected 405 allowing POST, but got %v %v", w.Code, w.Header())
+	}
+	if env["type"] != "exception" || env["code"] != "method_not_allowed" || env["tid"] != float64(2) {
+		t.Errorf("Expected method_not_allowed exception, but got %v", env)
+	}
+
+	r = newRequest(`{"action":"Catalog","method":"Save","type":"rpc","tid":3,"data":[["fig"]]}`)
+	r.Header.Set("If-Modified-Since", "Mon, 03 Oct 2016 12:00:00 GMT")
+	if w, env = route(rt, r); w.Code != 200 || env["result"] != float64(1) {
+		t.Errorf("Expected the write to run, but got %v %v", w.Code, env)
+	}
+	if h := w.Header().Get("Last-Modified"); h != "" {
+		t.Errorf("Expected no Last-Modified for a write, but got %q", h)
+	}
+}
+
+func TestRouterClientDeadline(t *testing.T) {
+	rt := newRouter(NewCodec(WithClientDeadline(time.Second)), new(Service1))
+	r := newRequest(`{"action":"Service1","method":"Sleep","type":"rpc","tid":1,"data":[{"A":500}]}`)
+	r.Header.Set("X-RPC-Deadline-Ms", "20")
+	start := time.Now()
+	w, env := route(rt, r)
+	if w.Code != http.StatusGatewayTimeout || env["code"] != "timeout" || env["tid"] != float64(1) {
+		t.Errorf("Expected timeout exception, but got %v %v", w.Code, env)
+	}
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Errorf("Expected the client deadline to apply, but the call took %v", elapsed)
+	}
+
+	r = newRequest(`{"action":"Service1","method":"Sleep","type":"rpc","tid":2,"data":[{"A":10}]}`)
+	r.Header.Set("X-RPC-Deadline-Ms", "5000")
+	if w, env = route(rt, r); w.Code != 200 || env["type"] != "rpc" {
+		t.Errorf("Expected result within the deadline, but got %v %v", w.Code, env)
+	}
+
+	if d := NewCodec(WithClientDeadline(time.Second)).timeout(r); d != time.Second {
+		t.Errorf("Expected deadline capped to 1s, but got %v", d)
+	}
+}
+
+func TestRouterTimestampTolerance(t *testing.T) {
+	rt := newRouter(NewCodec(WithTimestampTolerance(5*time.Minute)), new(Service1))
+	body := `{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":[{"A":4,"B":2}]}`
+	for ts, want := range map[string]int{
+		"":                                       200,
+		strconv.FormatInt(time.Now().Unix(), 10): 200,
+		strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10):     400,
+		strconv.FormatInt(time.Now().Add(-24*time.Hour).Unix(), 10): 400,
+		"tomorrow": 400,
+	} {
+		r := newRequest(body)
+		if ts != "" {
+			r.Header.Set("X-RPC-Timestamp", ts)
+		}
+		w, env := route(rt, r)
+		if w.Code != want {
+			t.Errorf("Expected %v for timestamp %q, but got %v %v", want, ts, w.Code, env)
+		}
+		if want == 400 && (env["code"] != "clock_skew" || env["tid"] != float64(1)) {
+			t.Errorf("Expected clock_skew exception for timestamp %q, but got %v", ts, env)
+		}
+	}
+}
+
+func TestRouterResponseSigning(t *testing.T) {
+	key := []byte("shared-secret")
+	rt := newRouter(NewCodec(WithResponseSigning(key)), new(Service1))
+	body, _ := EncodeClientRequest("Service1.Multiply", &Service1Request{A: 4, B: 2})
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, newRequest(string(body)))
+	sig := w.Header().Get("X-RPC-Signature")
+	if sig == "" {
+		t.Fatalf("Expected a signature, but got %v", w.Header())
+	}
+
+	var res Service1Response
+	if err := DecodeSignedClientResponse(bytes.NewReader(w.Body.Bytes()), sig, key, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected verified result 8, but got %v %v", res.Result, err)
+	}
+	if err := DecodeSignedClientResponse(bytes.NewReader(w.Body.Bytes()), sig, []byte("other"), &res); err != ErrBadSignature {
+		t.Errorf("Expected ErrBadSignature with another key, but got %v", err)
+	}
+	tampered := bytes.Replace(w.Body.Bytes(), []byte("8"), []byte("9"), 1)
+	if err := DecodeSignedClientResponse(bytes.NewReader(tampered), sig, key, &res); err != ErrBadSignature {
+		t.Errorf("Expected ErrBadSignature for a tampered body, but got %v", err)
+	}
+}
+
+func TestRouterSignedStreams(t *testing.T) {
+	key := []byte("shared-secret")
+	srv := httptest.NewServer(newRouter(NewCodec(WithResponseSigning(key), WithStreamingBatch()), new(Service1), new(Files)))
+	defer srv.Close()
+	for _, body := range []string{
+		`[{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":[{"A":4,"B":2}]},` +
+			`{"action":"Service1","method":"Multiply","type":"rpc","tid":2,"data":[{"A":3,"B":3}]}]`,
+		`{"action":"Files","method":"Get","type":"rpc","tid":3,"data":[{"Name":"a.txt"}]}`,
+	} {
+		resp, err := http.Post(srv.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.Header.Get(signatureHeader) != "" || len(resp.TransferEncoding) == 0 {
+			t.Errorf("Expected a streamed response, but got %v %v", resp.Header, resp.TransferEncoding)
+		}
+		if sig := resp.Trailer.Get(signatureHeader); sig != signBody(key, b) {
+			t.Errorf("Expected the signature of %q as a trailer, but got %q", b, sig)
+		}
+	}
+
+	resp, err := http.Post(srv.URL, "application/json", strings.NewReader(`{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":[{"A":4,"B":2}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var res Service1Response
+	if err := DecodeSignedHTTPResponse(resp, key, &res); err != nil || res.Result != 8 || resp.Header.Get(signatureHeader) == "" {
+		t.Errorf("Expected verified result 8 signed in the header, but got %v %v", res.Result, err)
+	}
+}
+
+func TestRouterEmptyBatch(t *testing.T) {
+	w, env := route(newRouter(NewCodec(), new(Service1)), newRequest(`[]`))
+	if w.Code != http.StatusBadRequest || env["type"] != "exception" || env["message"] != ErrEmptyBatch.Error() {
+		t.Errorf("Expected an empty batch exception, but got %v %q", w.Code, w.Body.String())
+	}
+
+	w, _ = route(newRouter(NewCodec(WithRejectEmptyBatch(false)), new(Service1)), newRequest(` [ ] `))
+	if w.Code != 200 || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("Expected an empty array, but got %v %q", w.Code, w.Body.String())
+	}
+}
+
+func TestRouterMaxHeaderBytes(t *testing.T) {
+	ts := httptest.NewUnstartedServer(newRouter(NewCodec(WithMaxHeaderBytes(4<<10)), new(Service1)))
+	ts.Config.MaxHeaderBytes = 64 << 10
+	ts.Start()
+	defer ts.Close()
+
+	post := func(cookie int) (*http.Response, map[string]interface{}) {
+		r, _ := http.NewRequest("POST", ts.URL, strings.NewReader(`{"action":"Service1","method":"Multiply","type":"rpc","tid":3,"data":[{"A":4,"B":2}]}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Cookie", "session="+strings.Repeat("x", cookie))
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var env map[string]interface{}
+		json.NewDecoder(res.Body).Decode(&env)
+		return res, env
+	}
+	if res, env := post(1 << 10); res.StatusCode != 200 || env["type"] != "rpc" {
+		t.Errorf("Expected a result, but got %v %v", res.StatusCode, env)
+	}
+	res, env := post(8 << 10)
+	if res.StatusCode != http.StatusRequestHeaderFieldsTooLarge || env["type"] != "exception" ||
+		env["code"] != "header_too_large" || env["tid"] != float64(3) {
+		t.Errorf("Expected a header_too_large exception, but got %v %v", res.StatusCode, env)
+	}
+}
+
+func TestRouterStreamingBatch(t *testing.T) {
+	reports := &Reports{started: make(chan bool), release: make(chan bool)}
+	srv := httptest.NewServer(newRouter(NewCodec(WithStreamingBatch(), WithPartialHeader()), reports, new(Service1)))
+	defer srv.Close()
+	body := `[{"action":"Service1","method":"Multiply","type":"rpc","tid":1,"data":[{"A":4,"B":2}]},` +
+		`{"action":"Reports","method":"Generate","type":"rpc","tid":2,"data":null},` +
+		`{"action":"Service1","method":"Multiply","type":"rpc","tid":3,"data":[{"A":3,"B":3}]}]`
+	// The response and its first envelope are read while the second call
+	// blocks.
+	var resp *http.Response
+	var raw bytes.Buffer
+	var dec *json.Decoder
+	var env map[string]interface{}
+	first := make(chan error, 1)
+	go func() {
+		var err error
+		if resp, err = http.Post(srv.URL, "application/json", strings.NewReader(body)); err != nil {
+			first <- err
+			return
+		}
+		dec = json.NewDecoder(io.TeeReader(resp.Body, &raw))
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+			first <- fmt.Errorf("expected the array to open, but got %v %v", tok, err)
+			return
+		}
+		first <- dec.Decode(&env)
+	}()
+	<-reports.started
+	var err error
+	select {
+	case err = <-first:
+	case <-time.After(5 * time.Second):
+		err = errors.New("timed out")
+	}
+	reports.release <- true
+	if err != nil || env["tid"] != float64(1) {
+		t.Fatalf("Expected the first envelope before the batch completes, but got %v %v", env, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 || len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("Expected a chunked response, but got %v %v", resp.StatusCode, resp.TransferEncoding)
+	}
+	for _, tid := range []float64{2, 3} {
+		env = nil
+		if err := dec.Decode(&env); err != nil || env["tid"] != tid {
+			t.Errorf("Expected envelope %v, but got %v %v", tid, env, err)
+		}
+	}
+	io.Copy(&raw, resp.Body)
+
+	var envs []map[string]interface{}
+	if err := json.Unmarshal(raw.Bytes(), &envs); err != nil || len(envs) != 3 {
+		t.Errorf("Expected a valid array of 3 envelopes, but got %q: %v", raw.String(), err)
+	}
+	if _, declared := resp.Trailer[http.CanonicalHeaderKey(partialHeader)]; !declared || resp.Trailer.Get(partialHeader) != "" {
+		t.Errorf("Expected an empty partial trailer, but got %v", resp.Trailer)
+	}
+}
+
+type Crash struct{}
+
+func (s *Crash) Now(r *http.Request, req *struct{}, res *string) error {
+	panic("crash")
+}
+
+func TestRouterPanicStack(t *testing.T) {
+	var logs bytes.Buffer
+	for _, opts := range [][]Option{nil, {WithCallTimeout(time.Second)}} {
+		opts = append(opts, WithDebug(), WithLogger(log.New(&logs, "", 0)))
+		rt := newRouter(NewCodec(opts...), new(Crash))
+		w, env := route(rt, newRequest(`{"action":"Crash","method":"Now","type":"rpc","tid":1,"data":null}`))
+		where, _ := env["where"].(string)
+		if w.Code != http.StatusInternalServerError || env["type"] != "exception" || !strings.Contains(where, "(*Crash).Now") {
+			t.Errorf("Expected the stack of the panic under where, but got %v %q", w.Code, w.Body.String())
+		}
+	}
+
+	// Outside debug mode the panic is answered without its stack.
+	rt := newRouter(NewCodec(WithLogger(log.New(&logs, "", 0))), new(Crash))
+	w, env := route(rt, newRequest(`[{"action":"Crash","method":"Now","type":"rpc","tid":1,"data":null}]`))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"message":"rpc: internal error"`) || strings.Contains(w.Body.String(), `"where"`) {
+		t.Errorf("Expected an internal error exception in the batch, but got %v %v %q", w.Code, env, w.Body.String())
+	}
+}
@@ -6,15 +6,24 @@
 package json
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
 
 	"github.com/gorilla/rpc"
 )
 
-var null = json.RawMessage([]byte("null"))
-
 // ----------------------------------------------------------------------------
 // Request and Response
 // ----------------------------------------------------------------------------
@@ -30,46 +39,364 @@ type serverRequest struct {
 	Id     *json.RawMessage `json:"tid"`
 	Type   string           `json:"type"`
 	Action string           `json:"action"`
+	// Binding is the binding hint of the call, "positional" or "named".
+	Binding string `json:"binding,omitempty"`
+	// version is the client version sent in the header selected by
+	// WithResponseRewrite.
+	version string
+	// accept is the name of the encoder requested in the X-RPC-Accept
+	// header.
+	accept string
 }
 
-// serverResponse represents a JSON-RPC response returned by the server.
-type serverResponse struct {
-	// The Object that was returned by the invoked method. This must be null
-	// in case there was an error invoking the method.
-	Result interface{} `json:"result"`
+// Envelope is a single ExtDirect response as written to the client.
+//
+// Successful calls produce envelopes of the request type (usually "rpc")
+// carrying Result; failed calls produce "exception" envelopes carrying
+// Message.
+type Envelope struct {
+	Type   string
+	Action string
+	Method string
 	// This must be the same id as the request it is responding to.
-	Id     *json.RawMessage `json:"tid"`
-	Type   string           `json:"type"`
-	Action string           `json:"action"`
-	Method string           `json:"method"`
+	Id *json.RawMessage
+	// The Object that was returned by the invoked method. It is not written
+	// for exceptions.
+	Result interface{}
+	// The error message of an exception. It is only written for exceptions.
+	Message interface{}
+	// Code is an optional machine readable exception code, taken from
+	// errors implementing a Code() string method. It is only written for
+	// exceptions, when not empty.
+	Code string
+	// Where is the stack where the error of an exception was created, for
+	// errors made with NewStackError and recovered panics, set in debug
+	// mode. It is only written for exceptions, when not empty.
+	Where string
+	// Data holds the partial reply of an exception, written under "data"
+	// when set, see WithPartialReply, or the payload of an event envelope.
+	Data interface{}
+	// Name is the name of an event envelope, of type "event".
+	Name string
+	// Meta holds additional information such as debugging data, written
+	// under "meta" when not empty.
+	Meta map[string]interface{}
+	// Extra holds additional top-level fields. They are written after the
+	// standard fields and replace any standard field of the same name.
+	Extra map[string]interface{}
+
+	// version is the version of the client the envelope is written to.
+	version string
+	// accept is the name of the encoder requested by the client.
+	accept string
+	// omitEmpty omits the empty optional fields, with WithOmitEmpty.
+	omitEmpty bool
+	// schemaVersion is written as schemaVersion, with WithSchemaVersion.
+	schemaVersion string
+	// pushed marks event envelopes pushed to polling providers, which
+	// answer no call and so have no tid, action and method.
+	pushed bool
 }
-type serverErrorResponse struct {
-	// An Error object if there was an error invoking the method. It must be
-	// null if there was no error.
-	Error interface{} `json:"message"`
-	// This must be the same id as the request it is responding to.
-	Id     *json.RawMessage `json:"tid"`
-	Type   string           `json:"type"`
-	Action string           `json:"action"`
-	Method string           `json:"method"`
+
+// MarshalJSON encodes the envelope as a single JSON object.
+func (e *Envelope) MarshalJSON() ([]byte, error) {
+	fields := map[string]interface{}{"type": e.Type}
+	if !e.pushed {
+		fields["tid"], fields["action"], fields["method"] = e.Id, e.Action, e.Method
+	}
+	if e.Type == "exception" {
+		fields["message"] = e.Message
+		if e.Code != "" {
+			fields["code"] = e.Code
+		}
+		if e.Where != "" {
+			fields["where"] = e.Where
+		}
+		if e.Data != nil {
+			fields["data"] = e.Data
+		}
+	} else if e.Type == "event" {
+		fields["name"] = e.Name
+		fields["data"] = e.Data
+	} else {
+		fields["result"] = e.Result
+	}
+	if len(e.Meta) > 0 {
+		fields["meta"] = e.Meta
+	}
+	if e.schemaVersion != "" {
+		fields["schemaVersion"] = e.schemaVersion
+	}
+	for k, v := range e.Extra {
+		fields[k] = v
+	}
+	if e.omitEmpty {
+		for k, v := range fields {
+			if !requiredFields[k] && isEmpty(v) {
+				delete(fields, k)
+			}
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// requiredFields are the envelope fields kept by WithOmitEmpty.
+var requiredFields = map[string]bool{
+	"type": true, "tid": true, "action": true, "method": true,
+	"result": true, "message": true,
+}
+
+// isEmpty reports whether v encodes as null, "", or an empty array or
+// object.
+func isEmpty(v interface{}) bool {
+	if raw, ok := v.(json.RawMessage); ok {
+		s := string(bytes.TrimSpace(raw))
+		return s == "null" || s == `""` || s == "[]" || s == "{}"
+	}
+	if isNil(v) {
+		return true
+	}
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	switch rv.Kind() {
+	case reflect.String, reflect.Map, reflect.Slice, reflect.Array:
+		return rv.Len() == 0
+	}
+	return false
 }
 
 // ----------------------------------------------------------------------------
 // Codec
 // ----------------------------------------------------------------------------
 
-// NewCodec returns a new JSON Codec.
-func NewCodec() *Codec {
-	return &Codec{}
+// NewCodec returns a new JSON Codec configured with the given options.
+func NewCodec(opts ...Option) *Codec {
+	c := &Codec{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
 // Codec creates a CodecRequest to process each request.
+//
+// Requests the codec rejects before a method is found, such as those
+// failing WithStrictTid, WithCanonicalTid or WithStrictType, are answered by
+// the rpc server with a plain text 400 response. A Router answers them with
+// ExtDirect exceptions instead.
 type Codec struct {
+	registry  *Registry
+	logger    *log.Logger
+	servedBy  string
+	finalizer func(env *Envelope)
+	// around wraps the building of the envelopes answering calls, as set
+	// by WithEnvelopeWrapper.
+	around    []func(next EnvelopeFunc) EnvelopeFunc
+	tokenAuth func(token string) (Principal, error)
+	dedupe    *dedupe
+	// duplicateAck answers deduplicated replays with a duplicate marker.
+	duplicateAck bool
+	inflight     coalescer
+	stats        stats
+	// correlationPath is the path of the correlation id in the data of
+	// calls, if set.
+	correlationPath string
+	// requestIDs enables request ids, which are echoed if echoID is set.
+	requestIDs, echoID bool
+	// poll serves the poll endpoint mounted by Router.Mount.
+	poll PollFunc
+	// strictPaths makes Router.Mount serve endpoints without a trailing
+	// slash only.
+	strictPaths bool
+
+	strictTid bool
+	// canonicalTid stores the canonical form of the tid of calls in their
+	// context.
+	canonicalTid bool
+	zeroFill     bool
+	debug        bool
+	// deprecations returns the notices recorded with Deprecate.
+	deprecations bool
+	// omitEmpty omits the empty optional fields of envelopes.
+	omitEmpty bool
+	// schemaVersion is the envelope format version written in envelopes.
+	schemaVersion string
+	// echoParams echoes the data of calls in debug mode.
+	echoParams bool
+	// allowEmptyBatch answers empty batches with an empty array.
+	allowEmptyBatch bool
+	// noStack disables the stack capture of debug mode.
+	noStack         bool
+	caseInsensitive bool
+	// strictType requires the type of requests to be exactly "rpc".
+	strictType      bool
+	strictLength    bool
+	errorRef        bool
+	validateMethods bool
+	unwrapData      bool
+	// qualifiedMethods splits fully-qualified method names sent without
+	// an action.
+	qualifiedMethods bool
+	partialReply     bool
+	// strictShape makes a Router reject requests whose batch header does
+	// not match the body.
+	strictShape bool
+
+	// HTTP status codes of notification and envelope responses. Zero means
+	// 200.
+	notificationStatus int
+	responseStatus     int
+
+	// Hooks applied to the request data and to the encoded results.
+	decrypt, encrypt CryptoFunc
+
+	// gzipLevel is the compression level of Router responses, if set.
+	gzipLevel *int
+	// maxHeaderBytes limits the size of the headers of Router requests.
+	maxHeaderBytes int
+	// signKey is the HMAC key signing Router responses, if set.
+	signKey []byte
+
+	// floatPrec is the number of decimal places of float results, if set.
+	floatPrec *int
+	// enums are the types encoded as their names in results.
+	enums map[reflect.Type]bool
+
+	// callTimeout bounds the duration of calls served by a Router.
+	callTimeout time.Duration
+	// timestampTolerance is the accepted distance between the request
+	// timestamp and the server time. Zero ignores timestamps.
+	timestampTolerance time.Duration
+	// maxDeadline caps the deadlines set by clients with the deadline
+	// header. Zero ignores the header.
+	maxDeadline   time.Duration
+	batchTimeout  BatchTimeoutPolicy
+	partialHeader bool
+	streamBatch   bool
+
+	// redirectHeader sets the X-RPC-Redirect header for Redirect results.
+	redirectHeader bool
+
+	// rewrite rewrites the envelopes of clients sending versionHeader.
+	rewrite       RewriteFunc
+	versionHeader string
+
+	// maxFieldSize limits the size of form fields other than files.
+	maxFieldSize int64
+
+	// uploads reports the progress of uploads, if set.
+	uploads *progressHub
+	// uploadSlots holds a token per multipart post being read, if set.
+	uploadSlots chan struct{}
+
+	// encoders are the envelope encoders clients may request.
+	encoders map[string]EncodeFunc
+
+	// recentErrors records the last exceptions, if set.
+	recentErrors *errorLog
+
+	// fanOut limits the calls dispatched from batches over time.
+	fanOut *fanOut
+
+	// semaphores limit the concurrent calls per action or method.
+	semaphores map[string]chan struct{}
 }
 
 // NewRequest returns a CodecRequest.
 func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
-	return newCodecRequest(r)
+	return newCodecRequest(r, c)
+}
+
+// encodeResult encodes a method reply, applying the enum names, the float
+// format and the encryption hook of the codec.
+func (c *Codec) encodeResult(reply interface{}) ([]byte, error) {
+	if c.enums != nil {
+		var err error
+		if reply, err = c.enumNames(reply); err != nil {
+			return nil, err
+		}
+	}
+	b, err := json.Marshal(reply)
+	if err != nil {
+		return nil, err
+	}
+	if c.floatPrec != nil {
+		b = formatFloats(b, *c.floatPrec)
+	}
+	if c.encrypt != nil {
+		return c.encrypt(b)
+	}
+	return b, nil
+}
+
+// setServedBy sets the X-Served-By header of w if the codec names its
+// instance.
+func (c *Codec) setServedBy(w http.ResponseWriter) {
+	if c.servedBy != "" {
+		w.Header().Set("X-Served-By", c.servedBy)
+	}
+}
+
+// lookup returns the registry settings of action.method, or nil if it has
+// none.
+func (c *Codec) lookup(action, method string) *Method {
+	if c.caseInsensitive {
+		return c.registry.lookupFold(action, method)
+	}
+	return c.registry.Lookup(action, method)
+}
+
+// isRead reports whether action.method is classified as a read in the
+// registry.
+func (c *Codec) isRead(action, method string) bool {
+	m := c.lookup(action, method)
+	return m != nil && m.Read
+}
+
+// checkMethod returns an error for methods missing from the registry when
+// the codec validates methods.
+func (c *Codec) checkMethod(action, method string) error {
+	if c.validateMethods && c.lookup(action, method) == nil {
+		return fmt.Errorf("rpc: unknown method %s.%s", action, method)
+	}
+	return nil
+}
+
+// checkData returns ErrDataTooLarge if the encoded data of req exceeds the
+// limit set for its method in the registry.
+func (c *Codec) checkData(req *serverRequest) error {
+	m := c.lookup(req.Action, req.Method)
+	if m != nil && m.MaxDataSize > 0 && req.Params != nil && len(*req.Params) > m.MaxDataSize {
+		return ErrDataTooLarge
+	}
+	return nil
+}
+
+// semaphore returns the semaphore limiting concurrent calls to
+// action.method, or nil if there is no limit. A limit set for the method
+// takes precedence over one set for its action. Methods in the registry
+// are limited under their registered names, so that clients cannot escape
+// the limit by changing the case of the names.
+func (c *Codec) semaphore(action, method string) chan struct{} {
+	if len(c.semaphores) == 0 {
+		return nil
+	}
+	if m := c.lookup(action, method); m != nil {
+		action, method = m.Action, m.Name
+	}
+	if sem, ok := c.semaphores[action+"."+method]; ok {
+		return sem
+	}
+	return c.semaphores[action]
+}
+
+// logf logs using the configured logger, or the standard logger if none
+// was set.
+func (c *Codec) logf(format string, v ...interface{}) {
+	if c.logger != nil {
+		c.logger.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
 }
 
 // ----------------------------------------------------------------------------
@@ -77,81 +404,626 @@ func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
 // ----------------------------------------------------------------------------
 
 // newCodecRequest returns a new CodecRequest.
-func newCodecRequest(r *http.Request) rpc.CodecRequest {
+func newCodecRequest(r *http.Request, codec *Codec) rpc.CodecRequest {
+	start := time.Now()
+	state := withCallState(r)
+	state.captureStack = codec.debug && !codec.noStack
+	var requestID string
+	if codec.requestIDs {
+		var ctx context.Context
+		ctx, requestID = withRequestID(r)
+		setContext(r, ctx)
+	}
+	err := codec.checkTimestamp(r)
+	// Authenticate the caller unless a Router already did.
+	if err == nil {
+		err = codec.authorize(r)
+	}
 	// Decode the request body and check if RPC method is valid.
 	req := new(serverRequest)
-	err := json.NewDecoder(r.Body).Decode(req)
-	r.Body.Close()
-	return &CodecRequest{request: req, err: err}
+	upload := false
+	var stream *ParamStream
+	if err == nil {
+		if isForm(r) {
+			if release, ok := codec.acquireUpload(r); !ok {
+				err = ErrBusy
+			} else {
+				done := codec.trackUpload(r)
+				limited := codec.limitFields(r)
+				upload, err = readForm(r, req)
+				if limited() {
+					err = ErrFieldTooLarge
+				}
+				done()
+				release()
+			}
+		} else if codec.streams() {
+			stream, err = codec.decodeStream(r, req)
+		} else {
+			err = codec.decodeBody(r, req)
+		}
+	}
+	if stream == nil {
+		// Streamed data is read from the body as the method runs.
+		r.Body.Close()
+	}
+	if err == nil && codec.qualifiedMethods {
+		splitMethod(req)
+	}
+	codec.readHeaders(r, req)
+	if err == nil {
+		err = codec.checkRequest(req)
+	}
+	if err == nil && codec.canonicalTid {
+		var tid string
+		var ok bool
+		if tid, ok, err = canonicalTid(req.Id); ok {
+			setContext(r, context.WithValue(r.Context(), tidKey{}, tid))
+		}
+	}
+	if err == nil {
+		err = codec.checkMethod(req.Action, req.Method)
+	}
+	if err == nil {
+		err = codec.checkData(req)
+	}
+	if err == nil && codec.unwrapData {
+		unwrapData(req)
+	}
+	if err == nil && codec.decrypt != nil && req.Params != nil {
+		var data []byte
+		if data, err = codec.decrypt(*req.Params); err == nil {
+			raw := json.RawMessage(data)
+			req.Params = &raw
+		}
+	}
+	if err == nil {
+		err = checkUploads(r, codec.lookup(req.Action, req.Method))
+	}
+	var correlationID string
+	if err == nil && codec.correlationPath != "" && req.Params != nil {
+		var ok bool
+		if correlationID, ok = extractPath(*req.Params, codec.correlationPath); ok {
+			setContext(r, context.WithValue(r.Context(), correlationIDKey{}, correlationID))
+		}
+	}
+	return &CodecRequest{
+		codec:         codec,
+		request:       req,
+		r:             r,
+		state:         state,
+		format:        r.Header.Get(formatHeader),
+		requestID:     requestID,
+		correlationID: correlationID,
+		upload:        upload,
+		stream:        stream,
+		start:         start,
+		err:           err,
+	}
+}
+
+// decodeBody decodes the body of r into req. With WithStrictContentLength
+// the whole body is read first and must match the declared length.
+func (c *Codec) decodeBody(r *http.Request, req *serverRequest) error {
+	if !c.strictLength {
+		return json.NewDecoder(r.Body).Decode(req)
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = checkContentLength(r, len(body))
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, req)
+}
+
+// splitMethod splits a fully-qualified method name such as "Users.load"
+// into the action and method of req, if its action is empty.
+func splitMethod(req *serverRequest) {
+	if req.Action != "" {
+		return
+	}
+	if i := strings.LastIndex(req.Method, "."); i > 0 && i < len(req.Method)-1 {
+		req.Action, req.Method = req.Method[:i], req.Method[i+1:]
+	}
+}
+
+// unwrapData replaces the data of req by its contents if it is a string
+// holding a JSON array or object, as sent by clients encoding data twice.
+func unwrapData(req *serverRequest) {
+	if req.Params == nil || len(*req.Params) == 0 || (*req.Params)[0] != '"' {
+		return
+	}
+	var s string
+	if err := json.Unmarshal(*req.Params, &s); err != nil {
+		return
+	}
+	s = strings.TrimSpace(s)
+	if s == "" || (s[0] != '[' && s[0] != '{') {
+		return
+	}
+	var raw json.RawMessage
+	if err := json.Unmarshal([]byte(s), &raw); err == nil {
+		req.Params = &raw
+	}
+}
+
+// checkContentLength returns ErrContentLength if n bytes were read from the
+// body of r while it declared another length.
+func checkContentLength(r *http.Request, n int) error {
+	if r.ContentLength >= 0 && r.ContentLength != int64(n) {
+		return ErrContentLength
+	}
+	return nil
+}
+
+// setContext replaces the context of r in place. gorilla/rpc passes the
+// request given to the codec on to the method, so this is how the codec
+// hands values to methods.
+func setContext(r *http.Request, ctx context.Context) {
+	*r = *r.WithContext(ctx)
+}
+
+// checkRequest checks the type and the tid of req, as required by
+// WithStrictType, WithStrictTid and WithCanonicalTid.
+func (c *Codec) checkRequest(req *serverRequest) error {
+	if err := c.checkType(req); err != nil {
+		return err
+	}
+	if c.strictTid && !isScalarTid(req.Id) {
+		return errors.New("rpc: request ill-formed: tid must be a number or a string")
+	}
+	if c.canonicalTid {
+		if _, _, err := canonicalTid(req.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkType checks the type of req. With WithStrictType it must be exactly
+// "rpc". Otherwise any case of "rpc" is accepted and normalized, and other
+// types are left to the server as before.
+func (c *Codec) checkType(req *serverRequest) error {
+	if !c.strictType {
+		if strings.EqualFold(req.Type, "rpc") {
+			req.Type = "rpc"
+		}
+		return nil
+	}
+	if req.Type != "rpc" {
+		return fmt.Errorf("rpc: request ill-formed: type must be \"rpc\", got %q", req.Type)
+	}
+	return nil
+}
+
+// isScalarTid reports whether id is absent, a JSON number or a JSON string.
+// A null tid decodes to a nil id.
+func isScalarTid(id *json.RawMessage) bool {
+	if id == nil || len(*id) == 0 {
+		return true
+	}
+	b := (*id)[0]
+	return b == '"' || b == '-' || (b >= '0' && b <= '9')
 }
 
 // CodecRequest decodes and encodes a single request.
 type CodecRequest struct {
+	codec   *Codec
 	request *serverRequest
+	r       *http.Request
+	state   *callState
+	format  string
+	// requestID is the id of the request, with WithRequestID.
+	requestID string
+	// correlationID is the id extracted with WithCorrelationPath.
+	correlationID string
+	upload        bool
+	// stream decodes the data of Stream methods.
+	stream  *ParamStream
+	start   time.Time
+	decoded time.Time
 	err     error
 }
 
 // Method returns the RPC method for the current request.
 //
 // The method uses a dotted notation as in "Service.Method".
+//
+// With WithCaseInsensitive, methods found in the registry are returned
+// with their registered case whatever the case sent by the client.
 func (c *CodecRequest) Method() (string, error) {
 	if c.err == nil {
+		if m := c.spec(); m != nil && c.codec.caseInsensitive {
+			return m.Action + "." + m.Name, nil
+		}
 		return c.request.Action + "." + c.request.Method, nil
 	}
 	return "", c.err
 }
 
+// spec returns the registry settings of the requested method, or nil if
+// it has none.
+func (c *CodecRequest) spec() *Method {
+	return c.codec.lookup(c.request.Action, c.request.Method)
+}
+
+// named reports whether the data of the call binds to the argument as a
+// whole, by name, rather than by position, its first element binding to
+// the argument. The binding hint of the call decides; without one, data of
+// SliceArg methods and objects bind by name and arrays by position.
+func (c *CodecRequest) named() (bool, error) {
+	switch c.request.Binding {
+	case "named":
+		return true, nil
+	case "positional":
+		return false, nil
+	case "":
+		if m := c.spec(); m != nil && m.SliceArg {
+			return true, nil
+		}
+		data := bytes.TrimSpace(*c.request.Params)
+		return len(data) > 0 && data[0] == '{', nil
+	}
+	return false, fmt.Errorf("rpc: request ill-formed: unknown binding %q", c.request.Binding)
+}
+
 // ReadRequest fills the request object for the RPC method.
+//
+// The first element of the data array is decoded into args, or the whole
+// data for methods marked SliceArg in the registry and for data sent as an
+// object, over the Defaults of the method. The binding member of the call,
+// "positional" or "named", forces either binding for methods accepting
+// both. An empty data array is an error unless the codec uses
+// WithZeroFillMissingArgs, in which case args is left with its zero value
+// or defaults.
 func (c *CodecRequest) ReadRequest(args interface{}) error {
 	if c.err == nil {
-		params := [1]interface{}{args}
-		if c.request.Params == nil { //ExtDirect data=null
-			c.request.Params = &null
-		} else {
+		c.err = c.readParams(args)
+	}
+	c.decoded = time.Now()
+	return c.err
+}
 
-			c.err = errors.New("rpc: method request ill-formed: missing params field")
+// readParams decodes the request data into args, over the default values
+// of the method.
+func (c *CodecRequest) readParams(args interface{}) error {
+	if m := c.spec(); m != nil && m.Stream {
+		p, ok := args.(*ParamStream)
+		if !ok {
+			return errors.New("rpc: stream method must take a *ParamStream argument")
 		}
-
-		c.err = json.Unmarshal(*c.request.Params, &params)
+		if c.stream != nil {
+			*p = *c.stream
+			c.stream = p
+		} else if c.request.Params != nil {
+			// The data was decoded before the method was known.
+			return errStreamOrder
+		}
+		return nil
 	}
-	return c.err
+	if m := c.spec(); m != nil && len(m.Defaults) > 0 && !m.SliceArg {
+		b, err := json.Marshal(m.Defaults)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, args); err != nil {
+			return err
+		}
+	}
+	if c.request.Params == nil {
+		// ExtDirect sends data=null for methods without arguments.
+		return nil
+	}
+	named, err := c.named()
+	if err != nil {
+		return err
+	}
+	if named {
+		return json.Unmarshal(*c.request.Params, args)
+	}
+	var params []json.RawMessage
+	if err := json.Unmarshal(*c.request.Params, &params); err != nil {
+		return err
+	}
+	if len(params) == 0 {
+		if c.codec.zeroFill {
+			return nil
+		}
+		return errors.New("rpc: method request ill-formed: expected 1 argument, got 0")
+	}
+	return json.Unmarshal(params[0], args)
 }
 
 // WriteResponse encodes the response and writes it to the ResponseWriter.
 //
 // The err parameter is the error resulted from calling the RPC method,
-// or nil if there was no error.
+// or nil if there was no error. The reply is only encoded when err is nil:
+// a method that fills its reply and also returns an error produces an
+// exception and the reply is discarded.
+//
+// For Stream methods, the tid and the other members following the data are
+// only decoded once the method returned.
+//
+// A method that set a modification time with SetLastModified gets a
+// Last-Modified header, and a 304 response with no body if the request
+// If-Modified-Since header shows the client already has the data.
 func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}, methodErr error) error {
+	if d, ok := reply.(*DownloadResult); ok {
+		defer d.close()
+	}
 	if c.err != nil {
 		return c.err
 	}
-	if methodErr != nil {
-		res := &serverErrorResponse{
-			Error:  methodErr.Error(),
-			Id:     c.request.Id,
-			Action: c.request.Action,
-			Type:   "exception",
-			Method: c.request.Method,
-		}
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		encoder := json.NewEncoder(w)
-		encoder.Encode(res)
-	} else {
-		res := &serverResponse{
-			Result: reply,
-			Id:     c.request.Id,
-			Action: c.request.Action,
-			Type:   c.request.Type,
-			Method: c.request.Method,
-		}
-		if c.request.Id == nil {
+	if c.stream != nil {
+		// Read the members of the call following the streamed data.
+		if err := c.stream.finish(c.codec, c.request); err != nil && methodErr == nil {
+			methodErr = err
+		}
+		c.r.Body.Close()
+	}
+	dispatched := time.Now()
+	c.observe(dispatched.Sub(c.start), methodErr)
+	c.codec.setServedBy(w)
+	c.codec.echoRequestID(w, c.requestID)
+	if methodErr == nil {
+		if d, ok := reply.(*DownloadResult); ok {
+			return c.codec.writeDownload(w, d)
+		} else if c.exportsCSV(reply) {
+			return writeCSV(w, c.request.Method+".csv", reply.(CSVExporter))
+		} else if c.request.Id == nil {
 			// Id is null for notifications and they don't have a response.
-			res.Id = &null
-		} else {
-			w.Header().Set("Content-Type", "application/json; charset=utf-8")
-			encoder := json.NewEncoder(w)
-			encoder.Encode(res)
+			if c.codec.notificationStatus != 0 {
+				w.WriteHeader(c.codec.notificationStatus)
+			}
+			return nil
+		} else if c.codec.isRead(c.request.Action, c.request.Method) && c.state.notModified(w, c.r) {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+		if rd, ok := reply.(*Redirect); ok && c.codec.redirectHeader && rd.URL != "" {
+			w.Header().Set(redirectHeader, rd.URL)
 		}
 	}
+	env := c.envelope(reply, methodErr, func(call *Call) *Envelope {
+		return c.buildEnvelope(call.Reply, call.Err, dispatched)
+	})
+	if env == nil {
+		env = newEnvelope(c.request)
+	}
+	status := http.StatusOK
+	if c.codec.responseStatus != 0 {
+		status = c.codec.responseStatus
+	}
+	if c.upload {
+		writeUploadEnvelope(w, status, c.codec.encodeEnvelope(env))
+		return nil
+	}
+	c.codec.writeEnvelope(w, status, env)
 	return nil
 }
+
+// buildEnvelope returns the envelope answering the call of c with the
+// reply and the error of the method.
+func (c *CodecRequest) buildEnvelope(reply interface{}, methodErr error, dispatched time.Time) *Envelope {
+	env := newEnvelope(c.request)
+	if methodErr != nil {
+		env = exception(c.request, methodErr)
+		if c.codec.errorRef {
+			c.addReference(env, methodErr)
+		}
+		if c.codec.partialReply && !isZero(reply) {
+			env.Data = reply
+		}
+		if st, ok := methodErr.(stacker); ok && c.codec.debug && !c.codec.noStack {
+			env.Where = st.Stack()
+		}
+	} else if e, ok := reply.(*Event); ok && e.Name != "" {
+		// The event replaces the result, under the tid of the call.
+		env.Type, env.Name, env.Data = "event", e.Name, e.Data
+	} else {
+		if m := c.spec(); m != nil && m.EmptyResult && isNil(reply) {
+			reply = struct{}{}
+		}
+		env.Result = reply
+		if c.codec.floatPrec != nil || c.codec.encrypt != nil || c.codec.enums != nil {
+			if b, err := c.codec.encodeResult(reply); err != nil {
+				env = exception(c.request, err)
+			} else {
+				env.Result = json.RawMessage(b)
+			}
+		}
+	}
+	if c.codec.deprecations {
+		if d := c.state.takeDeprecations(); len(d) > 0 {
+			if env.Meta == nil {
+				env.Meta = make(map[string]interface{})
+			}
+			env.Meta["deprecations"] = d
+		}
+	}
+	if c.correlationID != "" {
+		if env.Meta == nil {
+			env.Meta = make(map[string]interface{})
+		}
+		env.Meta["correlationId"] = c.correlationID
+	}
+	if c.codec.debug {
+		c.addTiming(env, dispatched)
+		if c.codec.servedBy != "" {
+			env.Meta["server"] = c.codec.servedBy
+		}
+		if c.codec.echoParams && c.request.Params != nil {
+			env.Meta["params"] = c.request.Params
+		}
+	}
+	return env
+}
+
+// stack returns the stack of the calling goroutine. Called while
+// recovering a panic, it holds the frames that panicked.
+func stack() string {
+	buf := make([]byte, 4096)
+	for {
+		n := runtime.Stack(buf, false)
+		if n < len(buf) {
+			return string(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// isNil reports whether v encodes as JSON null: it is nil or points to a
+// nil pointer, interface, map or slice.
+func isNil(v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return true
+		}
+		rv = rv.Elem()
+	}
+	return !rv.IsValid() || (rv.Kind() == reflect.Map || rv.Kind() == reflect.Slice) && rv.IsNil()
+}
+
+// isZero reports whether the value v points to is nil or its zero value.
+func isZero(v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return true
+		}
+		rv = rv.Elem()
+	}
+	return !rv.IsValid() || reflect.DeepEqual(rv.Interface(), reflect.Zero(rv.Type()).Interface())
+}
+
+// addReference tags the exception env with a short reference id, added to
+// its message and as meta.ref, and logs the id with err so that reports
+// from users can be matched with the server logs.
+func (c *CodecRequest) addReference(env *Envelope, err error) {
+	b := make([]byte, 4)
+	rand.Read(b)
+	ref := hex.EncodeToString(b)
+	env.Message = fmt.Sprintf("%v (ref %s)", env.Message, ref)
+	if env.Meta == nil {
+		env.Meta = make(map[string]interface{})
+	}
+	env.Meta["ref"] = ref
+	c.logf("rpc: error ref %s in %s.%s: %v", ref, c.request.Action, c.request.Method, err)
+}
+
+// addTiming adds the decode, dispatch and encode durations of the call to
+// the envelope meta, as meta.timing, in milliseconds. The result is encoded
+// here to measure the encoding time.
+func (c *CodecRequest) addTiming(env *Envelope, dispatched time.Time) {
+	start := time.Now()
+	if env.Result != nil {
+		if b, err := json.Marshal(env.Result); err == nil {
+			env.Result = json.RawMessage(b)
+		}
+	}
+	encoded := time.Now()
+	if env.Meta == nil {
+		env.Meta = make(map[string]interface{})
+	}
+	env.Meta["timing"] = map[string]float64{
+		"decode":   milliseconds(c.decoded.Sub(c.start)),
+		"dispatch": milliseconds(dispatched.Sub(c.decoded)),
+		"encode":   milliseconds(encoded.Sub(start)),
+	}
+}
+
+// milliseconds returns d as a fractional number of milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// newEnvelope returns an envelope answering req.
+func newEnvelope(req *serverRequest) *Envelope {
+	return &Envelope{
+		Type:    req.Type,
+		Action:  req.Action,
+		Method:  req.Method,
+		Id:      req.Id,
+		version: req.version,
+		accept:  req.accept,
+	}
+}
+
+// exception returns an exception envelope answering req with err.
+func exception(req *serverRequest, err error) *Envelope {
+	env := newEnvelope(req)
+	env.Type = "exception"
+	env.Message = err.Error()
+	if c, ok := err.(coder); ok {
+		env.Code = c.Code()
+	}
+	return env
+}
+
+// readHeaders sets the fields of req taken from the headers of r.
+func (c *Codec) readHeaders(r *http.Request, req *serverRequest) {
+	if c.rewrite != nil {
+		req.version = r.Header.Get(c.versionHeader)
+	}
+	if c.encoders != nil {
+		req.accept = r.Header.Get(acceptHeader)
+	}
+}
+
+// rewriteEnvelope applies the rewrite hook to the encoded envelope b for a
+// client of the given version.
+func (c *Codec) rewriteEnvelope(b []byte, version string) []byte {
+	var fields map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	// Numbers are kept as written, as float64 would round large integers.
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil {
+		return b
+	}
+	c.rewrite(version, fields)
+	if rb, err := json.Marshal(fields); err == nil {
+		return rb
+	}
+	return b
+}
+
+// ackDuplicate answers req, a replay of a successful call, with the
+// duplicate marker result.
+func (c *Codec) ackDuplicate(w http.ResponseWriter, req *serverRequest) {
+	env := newEnvelope(req)
+	env.Result = map[string]bool{"duplicate": true}
+	c.writeEnvelope(w, http.StatusOK, env)
+}
+
+// writeEnvelope finalizes env and writes it with the given HTTP status.
+func (c *Codec) writeEnvelope(w http.ResponseWriter, status int, env *Envelope) {
+	b := c.encodeEnvelope(env)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(append(b, '\n'))
+}
+
+// encodeEnvelope finalizes and encodes env.
+func (c *Codec) encodeEnvelope(env *Envelope) []byte {
+	if c.finalizer != nil {
+		c.finalizer(env)
+	}
+	if c.recentErrors != nil && env.Type == "exception" {
+		c.recentErrors.add(env)
+	}
+	env.omitEmpty = c.omitEmpty
+	env.schemaVersion = c.schemaVersion
+	b, _ := json.Marshal(env)
+	if c.rewrite != nil && env.version != "" {
+		b = c.rewriteEnvelope(b, env.version)
+	}
+	if f, ok := c.encoders[env.accept]; ok {
+		if eb, err := f(json.RawMessage(b)); err == nil {
+			b = eb
+		}
+	}
+	return b
+}
@@ -0,0 +1,91 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+)
+
+// signatureHeader is the response header holding the HMAC of the body, if
+// the codec uses WithResponseSigning.
+const signatureHeader = "X-RPC-Signature"
+
+// signBody returns the hex encoded HMAC-SHA256 of body with key.
+func signBody(key, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signingResponseWriter buffers the response written to an
+// http.ResponseWriter so that the signature of the whole body is sent in
+// the signature header before it.
+//
+// Responses that are flushed, such as streamed batches and downloads, are
+// not buffered from the first flush on: the signature is then sent as a
+// trailer, once the body is complete.
+type signingResponseWriter struct {
+	http.ResponseWriter
+	key    []byte
+	status int
+	body   []byte
+	// mac signs the body once it is streamed.
+	mac hash.Hash
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *signingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// Write implements http.ResponseWriter.
+func (w *signingResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.mac != nil {
+		w.mac.Write(p)
+		return w.ResponseWriter.Write(p)
+	}
+	w.body = append(w.body, p...)
+	return len(p), nil
+}
+
+// Flush implements http.Flusher. The first flush writes the header, with
+// the signature declared as a trailer, and the body buffered so far.
+func (w *signingResponseWriter) Flush() {
+	if w.mac == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Header().Add("Trailer", signatureHeader)
+		w.Header().Del("Content-Length")
+		w.mac = hmac.New(sha256.New, w.key)
+		w.mac.Write(w.body)
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.body)
+		w.body = nil
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close signs and writes the buffered response, or sets the signature
+// trailer of a streamed response.
+func (w *signingResponseWriter) close() {
+	if w.mac != nil {
+		w.Header().Set(signatureHeader, hex.EncodeToString(w.mac.Sum(nil)))
+		return
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.Header().Set(signatureHeader, signBody(w.key, w.body))
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(w.body)
+}
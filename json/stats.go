@@ -0,0 +1,96 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats holds counters collected by a codec.
+type Stats struct {
+	// Requests counts the calls dispatched to methods.
+	Requests uint64
+	// Errors counts the calls whose method returned an error.
+	Errors uint64
+	// SLAViolations counts the calls that took longer than the SLA set for
+	// their method in the registry.
+	SLAViolations uint64
+	// Duration is the total time spent decoding and serving calls.
+	Duration time.Duration
+	// DurationBuckets counts the calls by duration: DurationBuckets[i] is
+	// the number of calls that took at most DurationBounds()[i].
+	DurationBuckets []uint64
+}
+
+// durationBounds are the upper bounds of the call duration buckets.
+var durationBounds = [...]time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// DurationBounds returns the upper bounds of the call duration buckets of
+// Stats, in increasing order.
+func DurationBounds() []time.Duration {
+	return append([]time.Duration(nil), durationBounds[:]...)
+}
+
+// stats holds the live counters of a codec. Fields are updated atomically.
+type stats struct {
+	requests      uint64
+	errors        uint64
+	slaViolations uint64
+	duration      int64
+	// buckets counts calls per duration bound, not cumulatively.
+	buckets [len(durationBounds)]uint64
+}
+
+// Stats returns a snapshot of the codec counters.
+func (c *Codec) Stats() Stats {
+	s := Stats{
+		Requests:        atomic.LoadUint64(&c.stats.requests),
+		Errors:          atomic.LoadUint64(&c.stats.errors),
+		SLAViolations:   atomic.LoadUint64(&c.stats.slaViolations),
+		Duration:        time.Duration(atomic.LoadInt64(&c.stats.duration)),
+		DurationBuckets: make([]uint64, len(durationBounds)),
+	}
+	var n uint64
+	for i := range durationBounds {
+		n += atomic.LoadUint64(&c.stats.buckets[i])
+		s.DurationBuckets[i] = n
+	}
+	return s
+}
+
+// observe records the outcome of a call that took elapsed.
+func (c *CodecRequest) observe(elapsed time.Duration, err error) {
+	s := &c.codec.stats
+	atomic.AddUint64(&s.requests, 1)
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+	}
+	atomic.AddInt64(&s.duration, int64(elapsed))
+	for i, bound := range durationBounds {
+		if elapsed <= bound {
+			atomic.AddUint64(&s.buckets[i], 1)
+			break
+		}
+	}
+	m := c.spec()
+	if m != nil && m.SLA > 0 && elapsed > m.SLA {
+		atomic.AddUint64(&s.slaViolations, 1)
+		c.logf("rpc: warning: %s.%s took %v, exceeding its SLA of %v",
+			c.request.Action, c.request.Method, elapsed, m.SLA)
+	}
+}
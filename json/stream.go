@@ -0,0 +1,247 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// errStreamData is returned when the data of a Stream method is not an
+// array holding an array.
+var errStreamData = errors.New("rpc: method request ill-formed: streamed data must be an array of elements")
+
+// errStreamOrder is returned when the data of a Stream method is sent
+// before its action and method, so that it cannot be streamed.
+var errStreamOrder = errors.New("rpc: request ill-formed: the action and method must precede the data of stream methods")
+
+// errStreamTid is returned when the tid of a Stream method follows its
+// data although the codec checks tids, which must happen before the
+// method runs.
+var errStreamTid = errors.New("rpc: request ill-formed: the tid must precede the data of stream methods")
+
+// errStreamDecrypt is returned for calls of Stream methods when the codec
+// decrypts the data of calls, which must be read whole.
+var errStreamDecrypt = errors.New("rpc: stream methods cannot be called with encrypted data")
+
+// ParamStream is the argument of methods marked Stream in the registry. It
+// decodes the elements of the array sent as their argument one at a time,
+// as the method reads them, instead of decoding the whole array first:
+//
+//	func (s *Import) Rows(r *http.Request, rows *json.ParamStream, res *int) error {
+//		var row Row
+//		for rows.Next(&row) {
+//			...
+//		}
+//		return rows.Err()
+//	}
+//
+// The stream can only be read while the method runs.
+type ParamStream struct {
+	dec *json.Decoder
+	// body counts the bytes read from the request body. limit is the
+	// MaxDataSize of the method and base the offset of the data in the
+	// body.
+	body  *countingReader
+	limit int
+	base  int64
+	// inData and inArg are set while the decoder is in the data array and
+	// in the streamed argument.
+	inData, inArg bool
+	err           error
+}
+
+// Next decodes the next element into v. It returns false at the end of the
+// array or on error, reported by Err.
+func (s *ParamStream) Next(v interface{}) bool {
+	if !s.inArg || s.err != nil {
+		return false
+	}
+	if !s.dec.More() {
+		s.inArg = false
+		_, s.err = s.dec.Token()
+		return false
+	}
+	if s.err = s.dec.Decode(v); s.err != nil {
+		return false
+	}
+	if s.limit > 0 && s.offset()-s.base > int64(s.limit) {
+		s.err = ErrDataTooLarge
+		return false
+	}
+	return true
+}
+
+// offset returns the offset in the body of the next byte to decode.
+func (s *ParamStream) offset() int64 {
+	n := s.body.n
+	if b, ok := s.dec.Buffered().(interface{ Len() int }); ok {
+		n -= int64(b.Len())
+	}
+	return n
+}
+
+// countingReader counts the bytes read from a reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read implements io.Reader.
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// Err returns the error that stopped Next, if any.
+func (s *ParamStream) Err() error {
+	return s.err
+}
+
+// start opens the stream on the data value the decoder is at. It reports
+// whether the stream was opened; null data is consumed as an empty stream.
+func (s *ParamStream) start() (opened bool, err error) {
+	t, err := s.dec.Token()
+	if err != nil || t == nil {
+		return false, err
+	}
+	if d, ok := t.(json.Delim); !ok || d != '[' {
+		return false, errStreamData
+	}
+	s.base = s.offset() - 1
+	s.inData = true
+	if !s.dec.More() {
+		return true, nil
+	}
+	if t, err = s.dec.Token(); err != nil {
+		return true, err
+	}
+	if d, ok := t.(json.Delim); t != nil && (!ok || d != '[') {
+		return true, errStreamData
+	}
+	s.inArg = t != nil
+	return true, nil
+}
+
+// finish skips what the method did not read of the data array and
+// decodes the members of the call following it into req.
+func (s *ParamStream) finish(c *Codec, req *serverRequest) error {
+	if s.err != nil {
+		return s.err
+	}
+	for s.inArg && s.Next(new(json.RawMessage)) {
+	}
+	if s.err != nil {
+		return s.err
+	}
+	for s.dec.More() {
+		if err := s.dec.Decode(new(json.RawMessage)); err != nil {
+			return err
+		}
+	}
+	if _, err := s.dec.Token(); err != nil {
+		return err
+	}
+	s.inData = false
+	_, err := c.readFields(s.dec, req, nil)
+	return err
+}
+
+// streams reports whether the codec has methods marked Stream, whose calls
+// are decoded as streams.
+func (c *Codec) streams() bool {
+	return !c.strictLength && c.registry.hasStreams()
+}
+
+// decodeStream decodes the body of r into req like decodeBody, except for
+// the data of Stream methods: decoding stops there and the returned stream
+// decodes it as the method reads it. The stream is nil for other methods.
+// The action and method must precede the data to stream it, as must the
+// tid if the codec checks it.
+func (c *Codec) decodeStream(r *http.Request, req *serverRequest) (*ParamStream, error) {
+	body := &countingReader{r: r.Body}
+	dec := json.NewDecoder(body)
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := t.(json.Delim); !ok || d != '{' {
+		return nil, errors.New("rpc: request ill-formed: expected an object")
+	}
+	s := &ParamStream{dec: dec, body: body}
+	opened, err := c.readFields(dec, req, s)
+	if !opened {
+		return nil, err
+	}
+	return s, err
+}
+
+// requestField returns the field of req decoded from the member key of a
+// call, matched case-insensitively as encoding/json does, or nil if the
+// member is unknown.
+func requestField(req *serverRequest, key string) interface{} {
+	switch strings.ToLower(key) {
+	case "action":
+		return &req.Action
+	case "method":
+		return &req.Method
+	case "type":
+		return &req.Type
+	case "tid":
+		return &req.Id
+	case "data":
+		return &req.Params
+	case "binding":
+		return &req.Binding
+	}
+	return nil
+}
+
+// readFields decodes the members of the call object from dec into req,
+// up to its end. If s is not nil, decoding stops at the data of a Stream
+// method, opening s; opened reports it.
+func (c *Codec) readFields(dec *json.Decoder, req *serverRequest, s *ParamStream) (opened bool, err error) {
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return false, err
+		}
+		key, _ := t.(string)
+		if key == "data" && s != nil {
+			action := *req
+			if c.qualifiedMethods {
+				splitMethod(&action)
+			}
+			if m := c.lookup(action.Action, action.Method); m != nil && m.Stream {
+				if c.decrypt != nil {
+					return false, errStreamDecrypt
+				}
+				if (c.strictTid || c.canonicalTid) && req.Id == nil {
+					return false, errStreamTid
+				}
+				s.limit = m.MaxDataSize
+				if opened, err := s.start(); opened || err != nil {
+					return opened, err
+				}
+				continue
+			}
+		}
+		v := requestField(req, key)
+		if v == nil {
+			v = new(json.RawMessage)
+		}
+		if err := dec.Decode(v); err != nil {
+			return false, err
+		}
+	}
+	if _, err := dec.Token(); err != nil && err != io.EOF {
+		return false, err
+	}
+	return false, nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CompletionEvent is the name of the events Tasks.Poll delivers when a
+// task completes.
+const CompletionEvent = "complete"
+
+// ProgressToken is the reply of methods that cannot finish synchronously
+// and continue in the background. It is encoded under "result" as:
+//
+//	{"progressToken":"5f2b..."}
+//
+// The client tracks the completion of the task through the poll endpoint
+// of the Tasks that issued the token.
+type ProgressToken string
+
+// MarshalJSON encodes the token.
+func (t ProgressToken) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{"progressToken": string(t)})
+}
+
+// NewTasks returns an empty Tasks forgetting the tasks not completed
+// within ttl of their start, and the completions not delivered within ttl
+// of the completion. It panics if ttl is not positive.
+func NewTasks(ttl time.Duration) *Tasks {
+	if ttl <= 0 {
+		panic("rpc: task ttl must be positive")
+	}
+	return &Tasks{ttl: ttl, tasks: make(map[string]*taskState)}
+}
+
+// Tasks associates the progress tokens of background tasks with their
+// completion, delivered to polling clients.
+//
+// A method starts a task with Start, returns its token as reply and
+// completes it later with Complete. Poll, set with WithPoll, delivers a
+// CompletionEvent for each completed task whose token the client lists in
+// the "progressToken" parameters of its poll. The event data holds the
+// token, and the result or the error message of the task:
+//
+//	{"type":"event","name":"complete","data":{"progressToken":"5f2b...","result":42}}
+//
+// A task belongs to the principal of the call that started it, as set by
+// WithTokenAuth, and its completion is only delivered to polls of the same
+// principal. A completed task is forgotten once its event is delivered.
+type Tasks struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	tasks     map[string]*taskState
+	lastSweep time.Time
+}
+
+// taskState is the state of a task. done is set by Complete. The task is
+// forgotten after expires.
+type taskState struct {
+	owner   string
+	expires time.Time
+	done    bool
+	result  interface{}
+	err     error
+}
+
+// owner identifies the principal of r, like DefaultDedupeKey.
+func owner(r *http.Request) string {
+	p, _ := PrincipalFromContext(r.Context())
+	return fmt.Sprintf("%v", p)
+}
+
+// Start registers a new task of the principal of r and returns its token.
+func (t *Tasks) Start(r *http.Request) ProgressToken {
+	token := newRequestID()
+	t.mu.Lock()
+	now := time.Now()
+	t.sweep(now)
+	t.tasks[token] = &taskState{owner: owner(r), expires: now.Add(t.ttl)}
+	t.mu.Unlock()
+	return ProgressToken(token)
+}
+
+// Complete records the outcome of the task of token. It reports whether
+// the task is known and was not completed already.
+func (t *Tasks) Complete(token ProgressToken, result interface{}, err error) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.sweep(now)
+	s, ok := t.tasks[string(token)]
+	if !ok || s.done || now.After(s.expires) {
+		return false
+	}
+	s.done, s.result, s.err = true, result, err
+	s.expires = now.Add(t.ttl)
+	return true
+}
+
+// Poll is a PollFunc delivering the completion of the tasks listed in the
+// "progressToken" parameters of r. Pending and unknown tasks, and those of
+// other principals, have no event.
+func (t *Tasks) Poll(r *http.Request) ([]Event, error) {
+	r.ParseForm()
+	var events []Event
+	caller := owner(r)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.sweep(now)
+	for _, token := range r.Form["progressToken"] {
+		s, ok := t.tasks[token]
+		if !ok || !s.done || s.owner != caller || now.After(s.expires) {
+			continue
+		}
+		data := map[string]interface{}{"progressToken": token}
+		if s.err != nil {
+			data["message"] = s.err.Error()
+		} else {
+			data["result"] = s.result
+		}
+		events = append(events, Event{Name: CompletionEvent, Data: data})
+		delete(t.tasks, token)
+	}
+	return events, nil
+}
+
+// sweep forgets the expired tasks, at most once per ttl. t.mu must be
+// held.
+func (t *Tasks) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) <= t.ttl {
+		return
+	}
+	for token, s := range t.tasks {
+		if now.After(s.expires) {
+			delete(t.tasks, token)
+		}
+	}
+	t.lastSweep = now
+}
@@ -0,0 +1,58 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// errCanonicalTid is returned with WithCanonicalTid for tids that have no
+// canonical form.
+var errCanonicalTid = errors.New("rpc: request ill-formed: tid must be a number or a non-empty string")
+
+type tidKey struct{}
+
+// TidFromContext returns the canonical tid of the call, if the codec uses
+// WithCanonicalTid and the call has a tid.
+func TidFromContext(ctx context.Context) (string, bool) {
+	tid, ok := ctx.Value(tidKey{}).(string)
+	return tid, ok
+}
+
+// canonicalTid returns the canonical form of id: the value of string tids
+// and the shortest decimal form of numeric ones, so that 7, 7.0 and "7"
+// share the form "7". ok is false for a missing or null tid.
+func canonicalTid(id *json.RawMessage) (tid string, ok bool, err error) {
+	if id == nil || len(*id) == 0 || string(*id) == "null" {
+		return "", false, nil
+	}
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(*id))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return "", false, errCanonicalTid
+	}
+	switch v := v.(type) {
+	case string:
+		if v == "" {
+			return "", false, errCanonicalTid
+		}
+		return v, true, nil
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return strconv.FormatInt(i, 10), true, nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return "", false, errCanonicalTid
+		}
+		return strconv.FormatFloat(f, 'f', -1, 64), true, nil
+	}
+	return "", false, errCanonicalTid
+}
@@ -0,0 +1,38 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// timestampHeader is the request header a client may set to the time it
+// sent the request, in seconds since the Unix epoch, checked with
+// WithTimestampTolerance.
+const timestampHeader = "X-RPC-Timestamp"
+
+// checkTimestamp returns ErrClockSkew if r carries a timestamp further
+// than the codec tolerance from the current time, or one that cannot be
+// parsed. Requests without a timestamp are accepted.
+func (c *Codec) checkTimestamp(r *http.Request) error {
+	if c.timestampTolerance <= 0 {
+		return nil
+	}
+	h := r.Header.Get(timestampHeader)
+	if h == "" {
+		return nil
+	}
+	sec, err := strconv.ParseInt(h, 10, 64)
+	if err != nil {
+		return ErrClockSkew
+	}
+	skew := time.Unix(sec, 0).Sub(time.Now())
+	if skew > c.timestampTolerance || -skew > c.timestampTolerance {
+		return ErrClockSkew
+	}
+	return nil
+}
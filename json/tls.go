@@ -0,0 +1,89 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// maxInsecureBody is the size of the largest body of a plaintext request
+// read by RequireTLS to echo its calls in the exceptions rejecting them.
+const maxInsecureBody = 16 << 10
+
+// TLSPolicy configures RequireTLS.
+type TLSPolicy struct {
+	// ProtoHeader is the header a trusted reverse proxy sets to the scheme
+	// of the original request, such as "X-Forwarded-Proto". Requests with
+	// this header set to "https" are accepted. Empty trusts only the TLS
+	// state of the connection.
+	ProtoHeader string
+	// Redirect makes plaintext GET and HEAD requests, such as those
+	// loading the API descriptor, redirect to https instead of being
+	// rejected.
+	Redirect bool
+}
+
+// RequireTLS returns a handler passing requests made over TLS to h.
+//
+// Plaintext requests are answered with ErrInsecureTransport exceptions and
+// a 403 status, or redirected to https as configured by p. Their body is
+// only read to echo the calls of small JSON requests. The ProtoHeader
+// of p must only be set when every request goes through a proxy setting
+// it, as clients could set it otherwise.
+func RequireTLS(c *Codec, p TLSPolicy, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if secure(r, p.ProtoHeader) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if p.Redirect && (r.Method == "GET" || r.Method == "HEAD") {
+			u := *r.URL
+			u.Scheme = "https"
+			u.Host = r.Host
+			http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+			return
+		}
+		c.setServedBy(w)
+		calls, batch := insecureCalls(r)
+		c.reject(w, calls, batch, http.StatusForbidden, ErrInsecureTransport)
+	})
+}
+
+// insecureCalls returns the calls of the plaintext request r, to echo in
+// the exceptions rejecting them. Only small JSON bodies are read: form
+// posts and larger bodies are rejected with a single exception, without
+// spending more on a request that is refused anyway.
+func insecureCalls(r *http.Request) ([]*call, bool) {
+	if r.Method == "GET" {
+		c, _ := queryCall(r)
+		return []*call{c}, false
+	}
+	if !isForm(r) && r.ContentLength <= maxInsecureBody {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxInsecureBody+1))
+		if err == nil && len(body) <= maxInsecureBody {
+			if calls, batch, ok := parseCalls(body); ok {
+				return calls, batch
+			}
+		}
+	}
+	return []*call{{req: new(serverRequest)}}, false
+}
+
+// secure reports whether r was made over TLS, as told by the connection or
+// by the trusted protoHeader. With chained proxies the header lists a
+// scheme per hop and the first one is the scheme of the client.
+func secure(r *http.Request, protoHeader string) bool {
+	if r.TLS != nil {
+		return true
+	}
+	if protoHeader == "" {
+		return false
+	}
+	proto := strings.SplitN(r.Header.Get(protoHeader), ",", 2)[0]
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
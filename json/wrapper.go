@@ -0,0 +1,49 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Call is a call answered by the codec, once its method returned, as seen
+// by the wrappers set with WithEnvelopeWrapper.
+type Call struct {
+	Action string
+	Method string
+	// Tid is the tid of the call as sent by the client.
+	Tid *json.RawMessage
+	// Data is the data of the call as sent by the client, or nil.
+	Data json.RawMessage
+	// Request is the HTTP request of the call.
+	Request *http.Request
+	// Reply and Err are the reply and the error of the method.
+	Reply interface{}
+	Err   error
+}
+
+// EnvelopeFunc returns the envelope answering call.
+type EnvelopeFunc func(call *Call) *Envelope
+
+// envelope returns the envelope answering the call of c, built through the
+// wrappers of the codec.
+func (c *CodecRequest) envelope(reply interface{}, methodErr error, build EnvelopeFunc) *Envelope {
+	call := &Call{
+		Action:  c.request.Action,
+		Method:  c.request.Method,
+		Tid:     c.request.Id,
+		Request: c.r,
+		Reply:   reply,
+		Err:     methodErr,
+	}
+	if c.request.Params != nil {
+		call.Data = *c.request.Params
+	}
+	for i := len(c.codec.around) - 1; i >= 0; i-- {
+		build = c.codec.around[i](build)
+	}
+	return build(call)
+}